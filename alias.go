@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// aliasFile returns the path of the file where the aliases are saved.
+func aliasFile() (string, bool) {
+	dir, ok := configDir()
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(dir, "aliases"), true
+}
+
+// loadAliases reads the aliases from the file. Each line of the file
+// contains the alias name and the command separated by a space.
+// A missing file is not an error.
+func loadAliases(fname string) (map[string]string, error) {
+	aliases := make(map[string]string)
+
+	f, err := os.Open(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return aliases, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(fields) == 2 && !strings.HasPrefix(fields[0], "#") {
+			aliases[fields[0]] = strings.TrimSpace(fields[1])
+		}
+	}
+
+	return aliases, scanner.Err()
+}
+
+func (s *QMPShell) aliasNames() []string {
+	names := make([]string, 0, len(s.aliases))
+	for name := range s.aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// saveAliases writes all aliases to the file.
+func (s *QMPShell) saveAliases(fname string) error {
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+
+	for _, name := range s.aliasNames() {
+		fmt.Fprintf(&b, "%s %s\n", name, s.aliases[name])
+	}
+
+	return ioutil.WriteFile(fname, []byte(b.String()), 0644)
+}
+
+// expandAlias replaces the first word of the command line
+// with the aliased command. The rest of the line is appended
+// to the command, so an alias can be used with extra arguments.
+func (s *QMPShell) expandAlias(cmdline string) string {
+	fields := strings.SplitN(strings.TrimSpace(cmdline), " ", 2)
+
+	command, ok := s.aliases[fields[0]]
+	if !ok {
+		return cmdline
+	}
+
+	if len(fields) == 2 {
+		return command + " " + fields[1]
+	}
+
+	return command
+}
+
+// alias implements the "alias" command:
+//
+//	alias [list]               -- show all aliases
+//	alias <name> <command...>  -- define an alias
+//	alias save                 -- save the aliases to the file
+func (s *QMPShell) alias(ctx context.Context, args []string) (string, error) {
+	switch {
+	case len(args) == 1 || len(args) == 2 && args[1] == "list":
+		lines := make([]string, 0, len(s.aliases))
+		for _, name := range s.aliasNames() {
+			lines = append(lines, fmt.Sprintf("%s = %s", name, s.aliases[name]))
+		}
+		return strings.Join(lines, "\n"), nil
+	case len(args) == 2 && args[1] == "save":
+		fname, ok := aliasFile()
+		if !ok {
+			return "", fmt.Errorf("cannot determine the config directory")
+		}
+		if err := s.saveAliases(fname); err != nil {
+			return "", fmt.Errorf("cannot save aliases: %s", err)
+		}
+		return fmt.Sprintf("aliases saved to %s", fname), nil
+	case len(args) < 3:
+		return "", fmt.Errorf("usage: alias [list|save|<name> <command...>]")
+	}
+
+	name := args[1]
+
+	if _, ok := builtinCommands[name]; ok {
+		return "", fmt.Errorf("cannot redefine the built-in command: %s", name)
+	}
+
+	s.aliases[name] = strings.Join(args[2:], " ")
+
+	return "", nil
+}
+
+// unalias implements the "unalias <name>" command.
+func (s *QMPShell) unalias(ctx context.Context, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("usage: unalias <name>")
+	}
+
+	if _, ok := s.aliases[args[1]]; !ok {
+		return "", fmt.Errorf("no such alias: %s", args[1])
+	}
+
+	delete(s.aliases, args[1])
+
+	return "", nil
+}
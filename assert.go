@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stringList is a flag.Value for flags that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// assertion is a check of the command result given
+// as "<path>=<expected>" (see parseAssertion).
+type assertion struct {
+	spec     string
+	path     string
+	expected interface{}
+}
+
+// parseAssertion parses the assertion in the form "<path>=<expected>"
+// or "<path>==<expected>". The path is a jq-style path (see evalPath),
+// the expected value is JSON or, if it is not valid JSON, a plain string.
+func parseAssertion(spec string) (*assertion, error) {
+	idx := -1
+
+	for i := 0; i < len(spec) && idx == -1; i++ {
+		switch spec[i] {
+		case '"':
+			i, _ = stringEnd(spec, i)
+			i--
+		case '=':
+			idx = i
+		}
+	}
+
+	if idx == -1 {
+		return nil, fmt.Errorf("invalid assertion %q: expected <path>=<value>", spec)
+	}
+
+	path, value := strings.TrimSpace(spec[:idx]), strings.TrimSpace(strings.TrimPrefix(spec[idx+1:], "="))
+
+	// Checking the path syntax before running the command
+	if _, err := parsePath(path); err != nil {
+		return nil, fmt.Errorf("invalid assertion %q: %s", spec, err)
+	}
+
+	var expected interface{}
+	if err := decodeJSON([]byte(value), &expected); err != nil {
+		expected = value
+	}
+
+	return &assertion{spec: spec, path: path, expected: expected}, nil
+}
+
+// check evaluates the path against the result and returns an error
+// with the diff of the expected and actual values if they differ.
+// If the result is wrapped in a QMP response ({"return": ...}),
+// the path may be given relative to either of them.
+func (a *assertion) check(res interface{}) error {
+	actual, err := evalPath(res, a.path)
+	if inner, ok := unwrapReturn(res); err != nil && ok {
+		if v, e := evalPath(inner, a.path); e == nil {
+			actual, err = v, nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("assertion %s failed: %s", a.spec, err)
+	}
+
+	want, _ := json.MarshalIndent(a.expected, "", "    ")
+	got, _ := json.MarshalIndent(actual, "", "    ")
+
+	if string(want) == string(got) {
+		return nil
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "assertion %s failed:\n", a.spec)
+	for _, line := range strings.Split(string(want), "\n") {
+		fmt.Fprintf(&b, "- %s\n", line)
+	}
+	for _, line := range strings.Split(string(got), "\n") {
+		fmt.Fprintf(&b, "+ %s\n", line)
+	}
+
+	return fmt.Errorf("%s", strings.TrimSuffix(b.String(), "\n"))
+}
+
+// checkAssertions checks all assertions against the raw result
+// and prints the failed ones. It returns false if any of them failed.
+func checkAssertions(assertions []*assertion, raw json.RawMessage) bool {
+	if raw == nil {
+		Error.Println("assertions cannot be checked: the command has no QMP result")
+		return false
+	}
+
+	var res interface{}
+
+	if err := decodeJSON(raw, &res); err != nil {
+		Error.Println("assertions cannot be checked:", err)
+		return false
+	}
+
+	ok := true
+
+	for _, a := range assertions {
+		if err := a.check(res); err != nil {
+			Error.Println(err)
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// pathStep is an object key or an array index of the path.
+type pathStep struct {
+	key     string
+	index   int
+	isIndex bool
+
+	// The path up to and including the step, for the errors
+	prefix string
+}
+
+// parsePath parses the jq-style path: "." is the value itself,
+// ".key" or ".\"key\"" is a key of an object, "[N]" is an element
+// of an array (negative indexes count from the end).
+// For example: ".inserted.image.filename" or ".[0].qdev".
+func parsePath(path string) ([]pathStep, error) {
+	if !strings.HasPrefix(path, ".") {
+		return nil, fmt.Errorf("the path must start with \".\": %q", path)
+	}
+
+	var steps []pathStep
+
+	for i := 0; i < len(path); {
+		switch {
+		case path[i] == '.' && i+1 < len(path) && path[i+1] == '"':
+			end, ok := stringEnd(path, i+1)
+			if !ok {
+				return nil, fmt.Errorf("unterminated key in the path: %q", path)
+			}
+			key, err := strconv.Unquote(path[i+1 : end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid key in the path: %s", path[i+1:end])
+			}
+			steps = append(steps, pathStep{key: key, prefix: path[:end]})
+			i = end
+		case path[i] == '.':
+			end := i + 1
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			// "." alone or before an index is not a step
+			if end > i+1 {
+				steps = append(steps, pathStep{key: path[i+1 : end], prefix: path[:end]})
+			}
+			i = end
+		case path[i] == '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated index in the path: %q", path)
+			}
+			end += i + 1
+			n, err := strconv.Atoi(path[i+1 : end-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid index in the path: %s", path[i:end])
+			}
+			steps = append(steps, pathStep{index: n, isIndex: true, prefix: path[:end]})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected %q in the path: %q", path[i], path)
+		}
+	}
+
+	return steps, nil
+}
+
+// evalPath returns the part of the value specified
+// by the jq-style path (see parsePath).
+func evalPath(v interface{}, path string) (interface{}, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, st := range steps {
+		var ok bool
+
+		if st.isIndex {
+			arr, _ := v.([]interface{})
+			n := st.index
+			if n < 0 {
+				n += len(arr)
+			}
+			if ok = n >= 0 && n < len(arr); ok {
+				v = arr[n]
+			}
+		} else {
+			obj, _ := v.(map[string]interface{})
+			v, ok = obj[st.key]
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("%s: not found", st.prefix)
+		}
+	}
+
+	return v, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEvalPath(t *testing.T) {
+	var res interface{}
+
+	data := `{"status": "running", "devices": [{"id": "net0"}, {"id": "disk0"}], "a.b": {"c": 1}}`
+	if err := decodeJSON([]byte(data), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{".status", "running"},
+		{".devices[1].id", "disk0"},
+		{".devices[-2].id", "net0"},
+		{".devices.[0].id", "net0"},
+		{`."a.b".c`, "1"},
+		{".", res},
+	}
+
+	for _, tt := range tests {
+		got, err := evalPath(res, tt.path)
+		if err != nil {
+			t.Errorf("evalPath(%q) error: %s", tt.path, err)
+			continue
+		}
+		// Numbers are decoded as json.Number
+		if n, ok := got.(interface{ String() string }); ok {
+			got = n.String()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("evalPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	for _, path := range []string{".missing", ".devices[2]", ".status.x", "status", ".devices[x]", ".devices[0"} {
+		if _, err := evalPath(res, path); err == nil {
+			t.Errorf("evalPath(%q): expected an error", path)
+		}
+	}
+}
+
+func TestParseAssertion(t *testing.T) {
+	tests := []struct {
+		spec     string
+		path     string
+		expected interface{}
+	}{
+		{`.status="running"`, ".status", "running"},
+		{`.status==running`, ".status", "running"},
+		{`.running=true`, ".running", true},
+		{`."a=b"=null`, `."a=b"`, nil},
+	}
+
+	for _, tt := range tests {
+		a, err := parseAssertion(tt.spec)
+		if err != nil {
+			t.Errorf("parseAssertion(%q) error: %s", tt.spec, err)
+			continue
+		}
+		if a.path != tt.path || !reflect.DeepEqual(a.expected, tt.expected) {
+			t.Errorf("parseAssertion(%q) = %q, %v; want %q, %v", tt.spec, a.path, a.expected, tt.path, tt.expected)
+		}
+	}
+
+	for _, spec := range []string{".status", "status=1", ".a[=1"} {
+		if _, err := parseAssertion(spec); err == nil {
+			t.Errorf("parseAssertion(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestAssertionArrayResult(t *testing.T) {
+	for _, data := range []string{
+		`[{"id": "net0"}, {"id": "disk0"}]`,
+		`{"return": [{"id": "net0"}, {"id": "disk0"}]}`,
+	} {
+		var res interface{}
+		if err := decodeJSON([]byte(data), &res); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, spec := range []string{`.[1].id=disk0`, `.[-1].id="disk0"`} {
+			a, err := parseAssertion(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.check(res); err != nil {
+				t.Errorf("%s: check(%s) error: %s", data, spec, err)
+			}
+		}
+
+		a, _ := parseAssertion(`.[2].id=disk0`)
+		if err := a.check(res); err == nil {
+			t.Errorf("%s: check(.[2].id): expected an error", data)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// decodeBase64Fields decodes the base64 blobs of the result
+// specified as "<field-path>[:<file>]", where field-path is a list
+// of dot-separated keys (e.g. "buf-b64"). The blob is written
+// to the file if it is given, otherwise its hexdump is returned
+// to be shown after the result. The field value is replaced
+// with a short note in both cases.
+//
+// Fields that are not present in the result are ignored,
+// so the same paths can be used for all commands.
+func decodeBase64Fields(res interface{}, specs []string) (string, error) {
+	var dumps []string
+
+	for _, spec := range specs {
+		path, fname := spec, ""
+		if idx := strings.Index(spec, ":"); idx != -1 {
+			path, fname = spec[:idx], spec[idx+1:]
+		}
+
+		keys := strings.Split(path, ".")
+
+		obj, ok := res.(map[string]interface{})
+		for _, k := range keys[:len(keys)-1] {
+			if !ok {
+				break
+			}
+			obj, ok = obj[k].(map[string]interface{})
+		}
+		if !ok {
+			continue
+		}
+
+		last := keys[len(keys)-1]
+
+		value, ok := obj[last].(string)
+		if !ok {
+			continue
+		}
+
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("cannot decode %s: %s", path, err)
+		}
+
+		if len(fname) > 0 {
+			if err := ioutil.WriteFile(fname, data, 0644); err != nil {
+				return "", fmt.Errorf("cannot save %s: %s", path, err)
+			}
+			obj[last] = fmt.Sprintf("(%d bytes written to %s)", len(data), fname)
+			continue
+		}
+
+		obj[last] = fmt.Sprintf("(%d bytes, see below)", len(data))
+		dumps = append(dumps, fmt.Sprintf("%s:\n%s", path, strings.TrimSuffix(hex.Dump(data), "\n")))
+	}
+
+	return strings.Join(dumps, "\n"), nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0xef53/liner"
+)
+
+// BuiltinCommand is a command implemented by the shell itself
+// rather than by QEMU. It receives the command line split into words.
+type BuiltinCommand func(s *QMPShell, ctx context.Context, args []string) (string, error)
+
+// ShellOption is a runtime option that can be changed using
+// the "set <name> <value>" command.
+type ShellOption struct {
+	Get func(s *QMPShell) string
+	Set func(s *QMPShell, value string) error
+}
+
+var (
+	builtinCommands map[string]BuiltinCommand
+
+	shellOptions map[string]ShellOption
+)
+
+func init() {
+	builtinCommands = map[string]BuiltinCommand{
+		"set":           (*QMPShell).setOption,
+		"pci-tree":      (*QMPShell).pciTree,
+		"block-list":    (*QMPShell).blockList,
+		"net-list":      (*QMPShell).netList,
+		"cpu-info":      (*QMPShell).cpuInfo,
+		"event-stats":   (*QMPShell).eventStatsTable,
+		".timeout":      (*QMPShell).setTimeout,
+		"source":        (*QMPShell).source,
+		"oob":           (*QMPShell).oob,
+		"alias":         (*QMPShell).alias,
+		"unalias":       (*QMPShell).unalias,
+		"wait-event":    (*QMPShell).waitEvent,
+		".greeting":     (*QMPShell).showGreetingCmd,
+		"txn":           (*QMPShell).startTxn,
+		"migrate-watch": (*QMPShell).migrateWatch,
+		"jobs":          (*QMPShell).jobs,
+		"screenshot":    (*QMPShell).screenshot,
+		"job-progress":  (*QMPShell).jobProgress,
+		"wizard":        (*QMPShell).wizard,
+		"dump-state":    (*QMPShell).dumpState,
+		".commands":     (*QMPShell).listCommands,
+		"mirror":        (*QMPShell).mirror,
+		"dump":          (*QMPShell).dump,
+		"snapshot":      (*QMPShell).snapshot,
+		".reload":       (*QMPShell).reload,
+		".format":       (*QMPShell).setFormat,
+	}
+
+	shellOptions = map[string]ShellOption{
+		"histsize": {
+			Get: func(s *QMPShell) string { return strconv.Itoa(s.histSize) },
+			Set: func(s *QMPShell, v string) error {
+				var n int
+				if err := parseNonNegative(v, &n); err != nil {
+					return err
+				}
+				// liner keeps no more entries in memory
+				if n > liner.HistoryLimit {
+					return fmt.Errorf("expected at most %d", liner.HistoryLimit)
+				}
+				s.histSize = n
+				return nil
+			},
+		},
+		"histdedup": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.histDedup) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.histDedup) },
+		},
+		"validate": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.validate) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.validate) },
+		},
+		"deprecation-warnings": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.deprecationWarnings) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.deprecationWarnings) },
+		},
+		"history": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.histEnabled) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.histEnabled) },
+		},
+		"histignore": {
+			Get: func(s *QMPShell) string { return strings.Join(s.histIgnore, ",") },
+			Set: func(s *QMPShell, v string) error { s.histIgnore = parseList(v); return nil },
+		},
+		"require-args": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.requireArgs) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.requireArgs) },
+		},
+		"max-field": {
+			Get: func(s *QMPShell) string { return strconv.Itoa(s.maxField) },
+			Set: func(s *QMPShell, v string) error { return parseNonNegative(v, &s.maxField) },
+		},
+		"color": {
+			Get: func(s *QMPShell) string {
+				for _, name := range colorSchemeNames() {
+					if colorSchemes[name] == s.colors {
+						return name
+					}
+				}
+				return "custom"
+			},
+			Set: func(s *QMPShell, v string) error {
+				cs, ok := colorSchemes[v]
+				if !ok {
+					return fmt.Errorf("expected one of %s", strings.Join(colorSchemeNames(), ", "))
+				}
+				s.colors = cs
+				return nil
+			},
+		},
+		"humanize": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.humanize) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.humanize) },
+		},
+		"raw": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.format == outputRaw) },
+			Set: func(s *QMPShell, v string) error {
+				var raw bool
+				if err := parseSwitch(v, &raw); err != nil {
+					return err
+				}
+				if raw {
+					s.format = outputRaw
+				} else if s.format == outputRaw {
+					s.format = outputJSON
+				}
+				return nil
+			},
+		},
+		"confirm": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.confirmDangerous) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.confirmDangerous) },
+		},
+		"dangerous": {
+			Get: func(s *QMPShell) string { return strings.Join(s.dangerous, ",") },
+			Set: func(s *QMPShell, v string) error { s.dangerous = parseList(v); return nil },
+		},
+		"command-prefix": {
+			Get: func(s *QMPShell) string { return s.commandPrefix },
+			Set: func(s *QMPShell, v string) error { s.commandPrefix = v; return nil },
+		},
+		"shortcuts": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.shortcuts) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.shortcuts) },
+		},
+		"ctrlc": {
+			Get: func(s *QMPShell) string { return s.ctrlc },
+			Set: func(s *QMPShell, v string) error {
+				if v != ctrlcAbort && v != ctrlcClear {
+					return fmt.Errorf("expected %s or %s", ctrlcAbort, ctrlcClear)
+				}
+				s.ctrlc = v
+				return nil
+			},
+		},
+		"quiet-events": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.quietEvents) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.quietEvents) },
+		},
+		"quiet": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.quiet) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.quiet) },
+		},
+		"prompt": {
+			Get: func(s *QMPShell) string { return s.prompt },
+			Set: func(s *QMPShell, v string) error { s.prompt = v; return nil },
+		},
+		"decode-base64": {
+			Get: func(s *QMPShell) string { return strings.Join(s.decodeBase64, ",") },
+			Set: func(s *QMPShell, v string) error { s.decodeBase64 = parseList(v); return nil },
+		},
+		"relaxed-json": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.relaxedJSON) },
+			Set: func(s *QMPShell, v string) error { return parseSwitch(v, &s.relaxedJSON) },
+		},
+		"strict": {
+			Get: func(s *QMPShell) string { return formatSwitch(s.strict) },
+			Set: func(s *QMPShell, v string) error {
+				if s.schema == nil {
+					return fmt.Errorf("QMP schema is not available")
+				}
+				return parseSwitch(v, &s.strict)
+			},
+		},
+	}
+}
+
+// hasCommand returns true if QEMU supports the given command.
+func (s *QMPShell) hasCommand(name string) bool {
+	i := sort.SearchStrings(s.commands, name)
+	return i < len(s.commands) && s.commands[i] == name
+}
+
+// runBuiltin executes the command line if it is a built-in command.
+// The second return value is false if it is not.
+func (s *QMPShell) runBuiltin(ctx context.Context, cmdline string) (string, bool, error) {
+	args := s.splitString(cmdline, ' ')
+	if len(args) == 0 {
+		return "", false, nil
+	}
+
+	fn, ok := builtinCommands[args[0]]
+	if !ok {
+		return "", false, nil
+	}
+
+	s.recordCommand(cmdline)
+
+	res, err := fn(s, ctx, args)
+
+	return res, true, err
+}
+
+// setOption implements the "set" command:
+//
+//	set                  -- show all options
+//	set <name>           -- show the option value
+//	set <name> <value>   -- change the option value
+func (s *QMPShell) setOption(ctx context.Context, args []string) (string, error) {
+	switch len(args) {
+	case 1:
+		var names []string
+		for name := range shellOptions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		lines := make([]string, 0, len(names))
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("%s %s", name, shellOptions[name].Get(s)))
+		}
+		return strings.Join(lines, "\n"), nil
+	case 2, 3:
+	default:
+		return "", fmt.Errorf("usage: set [<option> [<value>]]")
+	}
+
+	opt, ok := shellOptions[args[1]]
+	if !ok {
+		return "", fmt.Errorf("unknown option: %s", args[1])
+	}
+
+	if len(args) == 3 {
+		if err := opt.Set(s, strings.Trim(args[2], "\"'")); err != nil {
+			return "", fmt.Errorf("invalid value for %s: %s", args[1], err)
+		}
+	}
+
+	return fmt.Sprintf("%s %s", args[1], opt.Get(s)), nil
+}
+
+// oob implements the "oob <command> [args...]" prefix that should
+// execute the command out-of-band (using "exec-oob").
+//
+// Out-of-band execution requires the "oob" capability to be enabled
+// during the capabilities negotiation, but the monitor always
+// negotiates without it. So the command is only parsed and
+// is never sent, since QEMU would reject it anyway.
+func (s *QMPShell) oob(ctx context.Context, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", fmt.Errorf("usage: oob <command> [arg-name1=arg1] ... [arg-nameN=argN]")
+	}
+
+	if _, err := s.buildQMPCommand(strings.Join(args[1:], " ")); err != nil {
+		return "", err
+	}
+
+	return "", ErrOOBNotAvailable
+}
+
+// showGreetingCmd implements the ".greeting" command that prints
+// the QMP greeting: QEMU version and the list of capabilities.
+func (s *QMPShell) showGreetingCmd(ctx context.Context, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: .greeting")
+	}
+
+	if s.greeting == nil {
+		return "", fmt.Errorf("QMP greeting is not available")
+	}
+
+	var res interface{}
+
+	if err := json.Unmarshal(s.greeting, &res); err != nil {
+		return "", err
+	}
+
+	b, err := json.MarshalIndent(res, "", "    ")
+	if err != nil {
+		return "", err
+	}
+
+	return colorizeJSON(string(b), s.colors), nil
+}
+
+// setTimeout implements the ".timeout [<duration>|off]" command
+// that sets the timeout for subsequent commands.
+func (s *QMPShell) setTimeout(ctx context.Context, args []string) (string, error) {
+	switch len(args) {
+	case 1:
+	case 2:
+		if args[1] == "off" {
+			s.cmdTimeout = 0
+			break
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d < 0 {
+			return "", fmt.Errorf("invalid timeout: %s", args[1])
+		}
+		s.cmdTimeout = d
+	default:
+		return "", fmt.Errorf("usage: .timeout [<duration>|off]")
+	}
+
+	if s.cmdTimeout == 0 {
+		return "timeout off", nil
+	}
+
+	return fmt.Sprintf("timeout %s", s.cmdTimeout), nil
+}
+
+// listCommands implements the ".commands [prefix]" command
+// that lists the commands supported by QEMU starting with the prefix.
+func (s *QMPShell) listCommands(ctx context.Context, args []string) (string, error) {
+	var prefix string
+
+	switch len(args) {
+	case 1:
+	case 2:
+		prefix = strings.ToLower(args[1])
+	default:
+		return "", fmt.Errorf("usage: .commands [prefix]")
+	}
+
+	names := completeFromList(s.commands, prefix)
+	if len(names) == 0 {
+		return "", fmt.Errorf("no commands starting with %q", prefix)
+	}
+
+	return strings.Join(names, "\n"), nil
+}
+
+// reload implements the ".reload" command that rebuilds the command
+// list and the schema (from QEMU or from the imported file) without
+// reconnecting, e.g. after QEMU has loaded a module. In the HMP mode
+// the HMP command list is rebuilt as well.
+func (s *QMPShell) reload(ctx context.Context, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: .reload")
+	}
+
+	run := func(cmd, res interface{}) error {
+		return s.run(ctx, cmd, res)
+	}
+
+	cmdlist, err := queryCommandList(run)
+	if err != nil {
+		return "", err
+	}
+
+	var schema *Schema
+
+	if len(s.schemaFile) > 0 {
+		if schema, err = LoadSchema(s.schemaFile); err != nil {
+			return "", err
+		}
+	} else {
+		schema = querySchema(run)
+	}
+
+	var added, removed []string
+
+	old := s.commands
+
+	for _, name := range cmdlist {
+		if i := sort.SearchStrings(old, name); i == len(old) || old[i] != name {
+			added = append(added, name)
+		}
+	}
+	for _, name := range old {
+		if i := sort.SearchStrings(cmdlist, name); i == len(cmdlist) || cmdlist[i] != name {
+			removed = append(removed, name)
+		}
+	}
+
+	s.commands, s.schema = cmdlist, schema
+
+	if s.strict && s.schema == nil {
+		Warning.Println("QMP schema is not available, strict mode is disabled")
+		s.strict = false
+	}
+
+	if s.isHMP {
+		s.loadHMPCommands()
+	}
+
+	// The device names are requested again on the next completion
+	s.hmpNamesTime = time.Time{}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d commands: %d added, %d removed", len(cmdlist), len(added), len(removed))
+	if schema == nil {
+		b.WriteString(", the schema is not available")
+	}
+	for _, name := range added {
+		fmt.Fprintf(&b, "\n+ %s", name)
+	}
+	for _, name := range removed {
+		fmt.Fprintf(&b, "\n- %s", name)
+	}
+
+	return b.String(), nil
+}
+
+func parseSwitch(v string, dst *bool) error {
+	switch strings.ToLower(v) {
+	case "on", "true", "yes", "1":
+		*dst = true
+	case "off", "false", "no", "0":
+		*dst = false
+	default:
+		return fmt.Errorf("expected on or off")
+	}
+	return nil
+}
+
+func formatSwitch(v bool) string {
+	if v {
+		return "on"
+	}
+	return "off"
+}
+
+func parseList(v string) []string {
+	var list []string
+
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+func parseNonNegative(v string, dst *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return fmt.Errorf("expected a non-negative integer")
+	}
+	*dst = n
+	return nil
+}
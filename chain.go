@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// splitChain splits the command line into commands separated
+// by "&&" or ";". Separators inside quotes and JSON values
+// are ignored. The second return value contains the separators.
+func splitChain(cmdline string) ([]string, []string, error) {
+	var cmds, ops []string
+	var q quoteState
+	var depth int
+
+	start := 0
+
+	for i := 0; i < len(cmdline); i++ {
+		c := cmdline[i]
+
+		if q.next(rune(c)) {
+			continue
+		}
+
+		switch {
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		case depth > 0:
+		case c == ';':
+			cmds = append(cmds, strings.TrimSpace(cmdline[start:i]))
+			ops = append(ops, ";")
+			start = i + 1
+		case c == '&' && i+1 < len(cmdline) && cmdline[i+1] == '&':
+			cmds = append(cmds, strings.TrimSpace(cmdline[start:i]))
+			ops = append(ops, "&&")
+			i++
+			start = i + 1
+		}
+	}
+
+	if len(ops) == 0 {
+		return []string{cmdline}, nil, nil
+	}
+
+	cmds = append(cmds, strings.TrimSpace(cmdline[start:]))
+
+	for i, cmd := range cmds {
+		switch {
+		case len(cmd) > 0:
+		case i < len(ops):
+			return nil, nil, fmt.Errorf("syntax error: missing command before %q", ops[i])
+		case ops[i-1] != ";":
+			return nil, nil, fmt.Errorf("syntax error: missing command after %q", ops[i-1])
+		default:
+			// A trailing ";" is allowed
+			cmds, ops = cmds[:i], ops[:i-1]
+		}
+	}
+
+	return cmds, ops, nil
+}
+
+// stripComment splits the command line into the command and
+// the trailing comment: a "#" at the beginning of the line or after
+// a whitespace, if it is not inside quotes or a JSON value.
+// Both parts are trimmed.
+func stripComment(cmdline string) (string, string) {
+	var q quoteState
+	var depth int
+
+	for i := 0; i < len(cmdline); i++ {
+		c := cmdline[i]
+
+		if q.next(rune(c)) {
+			continue
+		}
+
+		switch {
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		case depth > 0:
+		case c == '#' && (i == 0 || cmdline[i-1] == ' ' || cmdline[i-1] == '\t'):
+			return strings.TrimSpace(cmdline[:i]), strings.TrimSpace(cmdline[i:])
+		}
+	}
+
+	return strings.TrimSpace(cmdline), ""
+}
+
+// executeChain executes the commands one by one. A command that
+// follows "&&" is executed only if the previous one succeeded.
+// The results of all commands but the last one executed are printed
+// as they are received (errors go to stderr), the result of the last
+// one is returned as is. In the JSON output mode each command
+// gets its own JSON record.
+func (s *QMPShell) executeChain(ctx context.Context, cmds, ops []string) (string, error) {
+	var res string
+	var err error
+
+	for i, cmdline := range cmds {
+		if i > 0 {
+			if err != nil && ops[i-1] == "&&" {
+				return s.jsonResult(cmds[i-1], res, err)
+			}
+			if s.jsonOut {
+				fmt.Println(s.formatJSONRecord(cmds[i-1], res, err))
+			} else {
+				if len(res) > 0 {
+					fmt.Println(res)
+				}
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+		}
+
+		res, err = s.executeOne(ctx, cmdline)
+
+		switch err {
+		case ErrConnectionClosed, ErrCommandInterrupted:
+			return s.jsonResult(cmdline, res, err)
+		}
+	}
+
+	return s.jsonResult(cmds[len(cmds)-1], res, err)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// ColorScheme contains the SGR parameters of the ANSI escape
+// sequences used to highlight JSON values. Empty fields mean
+// that values of that kind are not highlighted.
+type ColorScheme struct {
+	Key    string
+	String string
+	Number string
+	Bool   string
+	Null   string
+}
+
+var colorSchemes = map[string]ColorScheme{
+	"default": {Key: "34", String: "32", Number: "33", Bool: "35", Null: "36"},
+	"dark":    {Key: "1;94", String: "1;92", Number: "1;93", Bool: "1;95", Null: "1;96"},
+	"light":   {Key: "38;5;24", String: "38;5;28", Number: "38;5;130", Bool: "38;5;90", Null: "38;5;244"},
+	"none":    {},
+}
+
+func colorSchemeNames() []string {
+	names := make([]string, 0, len(colorSchemes))
+	for name := range colorSchemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (cs *ColorScheme) paint(b *strings.Builder, code, text string) {
+	if len(code) == 0 {
+		b.WriteString(text)
+		return
+	}
+	b.WriteString("\x1b[" + code + "m" + text + "\x1b[0m")
+}
+
+// colorizeJSON highlights the formatted JSON document.
+// The input is expected to be valid JSON.
+func colorizeJSON(data string, cs ColorScheme) string {
+	if cs == (ColorScheme{}) {
+		return data
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(data); {
+		c := data[i]
+
+		switch {
+		case c == '"':
+			j := i + 1
+			for ; j < len(data) && data[j] != '"'; j++ {
+				if data[j] == '\\' {
+					j++
+				}
+			}
+			j++
+			if j > len(data) {
+				j = len(data)
+			}
+
+			// A string followed by a colon is an object key
+			code := cs.String
+			if strings.HasPrefix(strings.TrimLeft(data[j:], " \t\n"), ":") {
+				code = cs.Key
+			}
+
+			cs.paint(&b, code, data[i:j])
+			i = j
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for ; j < len(data) && strings.IndexByte("0123456789.eE+-", data[j]) != -1; j++ {
+			}
+			cs.paint(&b, cs.Number, data[i:j])
+			i = j
+		case strings.HasPrefix(data[i:], "true"):
+			cs.paint(&b, cs.Bool, "true")
+			i += 4
+		case strings.HasPrefix(data[i:], "false"):
+			cs.paint(&b, cs.Bool, "false")
+			i += 5
+		case strings.HasPrefix(data[i:], "null"):
+			cs.paint(&b, cs.Null, "null")
+			i += 4
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// pathArguments is a list of argument names that usually take
+// a path to a local file. If the schema is available, it is used
+// to make sure that the argument is really a string.
+var pathArguments = map[string]struct{}{
+	"file":          struct{}{},
+	"filename":      struct{}{},
+	"path":          struct{}{},
+	"snapshot-file": struct{}{},
+	"target":        struct{}{},
+}
+
+// Completion engines, see complete.
+const (
+	completionNamesOnly = "names-only"
+	completionSchema    = "schema"
+	completionNone      = "none"
+)
+
+var completionEngines = []string{completionNamesOnly, completionSchema, completionNone}
+
+// completionShortcuts are the frequently used command lines offered
+// for the first word along with the command names if the "shortcuts"
+// option is on. A shortcut is offered only if QEMU supports
+// its command (human-monitor-command for the "hmp" ones).
+var completionShortcuts = []string{
+	"hmp info block",
+	"hmp info chardev",
+	"hmp info cpus",
+	"hmp info migrate",
+	"hmp info mtree -f",
+	"hmp info network",
+	"hmp info pci",
+	"hmp info qtree",
+	"hmp info status",
+	"hmp info version",
+	"query-blockstats query-nodes=true",
+	"query-named-block-nodes flat=true",
+	"query-qmp-schema",
+}
+
+// complete is a liner.WordCompleter for the QMP commands.
+// The first word of the line is completed as a command name,
+// values of the path-taking arguments are completed as file paths.
+// With the schema completion engine argument names and enumeration
+// values are completed as well.
+func (s *QMPShell) complete(line string, pos int) (string, []string, string) {
+	head, tail := string([]rune(line)[:pos]), string([]rune(line)[pos:])
+
+	idx := strings.LastIndexAny(head, " \t")
+	if idx == -1 {
+		c := completeFromList(s.commands, strings.ToLower(head))
+		if len(s.commandPrefix) > 0 {
+			c = completeFromList(c, s.commandPrefix)
+		}
+		c = append(c, completeFromList(s.aliasNames(), head)...)
+		c = append(c, completeFromList([]string{strings.TrimSpace(hmpPrefix)}, head)...)
+		if s.shortcuts {
+			c = append(c, completeFromList(s.availableShortcuts(), head)...)
+		}
+		return "", c, tail
+	}
+
+	if s.shortcuts && strings.HasPrefix(head, hmpPrefix) {
+		if c := completeFromList(s.availableShortcuts(), head); len(c) > 0 {
+			return "", c, tail
+		}
+	}
+
+	word := head[idx+1:]
+	head = head[:idx+1]
+
+	fields := strings.Fields(head)
+	if len(fields) == 0 {
+		// Nothing but whitespace before the word
+		return head + word, nil, tail
+	}
+
+	cmdname := fields[0]
+	useSchema := s.completion == completionSchema && s.schema != nil
+
+	parts := strings.SplitN(word, "=", 2)
+	if len(parts) != 2 {
+		if useSchema {
+			return head, s.completeArgumentName(cmdname, head, word), tail
+		}
+		return head + word, nil, tail
+	}
+
+	key, value := parts[0], parts[1]
+
+	switch {
+	case key == "protocol" && strings.HasPrefix(value, "file:"):
+		return head + key + "=file:", completePath(value[len("file:"):]), tail
+	case s.isPathArgument(cmdname, key):
+		return head + key + "=", completePath(value), tail
+	}
+
+	var values []string
+
+	if useSchema {
+		if arg := s.schema.Argument(cmdname, key); arg != nil {
+			values = s.schema.EnumValues(arg.Type)
+			if s.schema.JSONType(arg.Type) == "boolean" {
+				values = []string{"true", "false"}
+			}
+		}
+	}
+
+	// The values used earlier in the session, the most recent first
+	used := s.argValues[key]
+	for i := len(used) - 1; i >= 0; i-- {
+		values = append(values, used[i])
+	}
+
+	if c := uniqueStrings(completeFromList(values, value)); len(c) > 0 {
+		return head + key + "=", c, tail
+	}
+
+	return head + word, nil, tail
+}
+
+// availableShortcuts returns the completionShortcuts
+// whose commands are supported by QEMU.
+func (s *QMPShell) availableShortcuts() (list []string) {
+	for _, sc := range completionShortcuts {
+		name := strings.Fields(sc)[0]
+		if name+" " == hmpPrefix {
+			name = "human-monitor-command"
+		}
+		if s.hasCommand(name) {
+			list = append(list, sc)
+		}
+	}
+	return
+}
+
+// maxArgValues is the maximum number of values
+// remembered for each argument name.
+const maxArgValues = 50
+
+// rememberArgValue saves the value of the argument, so that
+// it is offered for completion later. Values with whitespace
+// or quotes, JSON values and the values of the arguments
+// in the histignore list (e.g. passwords) are not saved.
+func (s *QMPShell) rememberArgValue(name, value string) {
+	if len(value) == 0 || strings.ContainsAny(value, " \t\"'{[") {
+		return
+	}
+
+	for _, n := range s.histIgnore {
+		if n == name {
+			return
+		}
+	}
+
+	if s.argValues == nil {
+		s.argValues = make(map[string][]string)
+	}
+
+	values := s.argValues[name]
+
+	// Moving the value to the end as the most recent one
+	for i, v := range values {
+		if v == value {
+			values = append(values[:i], values[i+1:]...)
+			break
+		}
+	}
+
+	values = append(values, value)
+	if len(values) > maxArgValues {
+		values = values[1:]
+	}
+
+	s.argValues[name] = values
+}
+
+// uniqueStrings removes duplicates from the list keeping the order.
+func uniqueStrings(list []string) []string {
+	seen := make(map[string]struct{}, len(list))
+	out := list[:0]
+
+	for _, v := range list {
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		out = append(out, v)
+	}
+
+	return out
+}
+
+// completeArgumentName returns the names (followed by "=")
+// of the command arguments that start with the prefix
+// and are not yet given in the command line.
+func (s *QMPShell) completeArgumentName(cmdname, head, prefix string) (c []string) {
+	given := make(map[string]struct{})
+	for _, arg := range strings.Fields(head)[1:] {
+		given[strings.SplitN(arg, "=", 2)[0]] = struct{}{}
+	}
+
+	for _, m := range s.schema.Arguments(cmdname) {
+		if _, ok := given[m.Name]; ok {
+			continue
+		}
+		if strings.HasPrefix(m.Name, prefix) {
+			c = append(c, m.Name+"=")
+		}
+	}
+
+	sort.Strings(c)
+
+	return c
+}
+
+func (s *QMPShell) isPathArgument(cmdname, argname string) bool {
+	if _, ok := pathArguments[argname]; !ok {
+		return false
+	}
+
+	if s.schema != nil {
+		if arg := s.schema.Argument(cmdname, argname); arg == nil || s.schema.JSONType(arg.Type) != "string" {
+			return false
+		}
+	}
+
+	return true
+}
+
+func completeFromList(list []string, prefix string) (c []string) {
+	for _, n := range list {
+		if strings.HasPrefix(n, prefix) {
+			c = append(c, n)
+		}
+	}
+	return
+}
+
+// completePath returns a list of files and directories
+// whose paths start with the given prefix.
+func completePath(prefix string) (c []string) {
+	dir, base := filepath.Split(prefix)
+
+	listdir := dir
+	if len(listdir) == 0 {
+		listdir = "."
+	}
+
+	entries, err := ioutil.ReadDir(listdir)
+	if err != nil {
+		return nil
+	}
+
+	for _, fi := range entries {
+		name := fi.Name()
+
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		// Hidden files are shown only if explicitly requested
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if st, err := os.Stat(filepath.Join(listdir, name)); err == nil {
+				fi = st
+			}
+		}
+
+		if fi.IsDir() {
+			name += "/"
+		}
+
+		c = append(c, dir+name)
+	}
+
+	return c
+}
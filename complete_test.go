@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCompleteLeadingWhitespace(t *testing.T) {
+	s := new(QMPShell)
+
+	for _, line := range []string{"  file=/t", "\tfilename=/t"} {
+		head, c, tail := s.complete(line, len([]rune(line)))
+		if head+tail != line || len(c) != 0 {
+			t.Errorf("complete(%q) = %q, %v, %q, want the line unchanged", line, head, c, tail)
+		}
+	}
+}
+
+func TestCompleteWhitespaceOnly(t *testing.T) {
+	s := &QMPShell{
+		completion: completionSchema,
+		schema:     NewSchema(nil),
+	}
+
+	for _, line := range []string{" ", "   ", " \t"} {
+		head, c, tail := s.complete(line, len([]rune(line)))
+		if head+tail != line || len(c) != 0 {
+			t.Errorf("complete(%q) = %q, %v, %q, want the line unchanged", line, head, c, tail)
+		}
+	}
+}
+
+func TestRememberArgValuePrivate(t *testing.T) {
+	s := &QMPShell{histIgnore: defaultHistIgnore}
+
+	for _, cmdline := range []string{
+		"set_password protocol=vnc password=secret1",
+		"change-vnc-password password=secret2",
+		"object-add qom-type=secret id=sec0 data=secret3",
+		"blockdev-add driver=luks node-name=secret4 key-secret=sec0",
+	} {
+		if _, err := s.buildQMPCommand(cmdline); err != nil {
+			t.Fatalf("%s: %s", cmdline, err)
+		}
+	}
+
+	// Nothing is remembered from the private command lines
+	for _, name := range []string{"protocol", "password", "driver", "node-name", "key-secret"} {
+		if values := s.argValues[name]; len(values) > 0 {
+			t.Errorf("%s = %v, want nothing", name, values)
+		}
+	}
+
+	if values := s.argValues["data"]; len(values) != 1 || values[0] != "secret3" {
+		t.Errorf("data = %v, want [secret3]", values)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/0xef53/liner"
+)
+
+var errCancelled = errors.New("cancelled")
+
+// defaultDangerous is a list of commands (QMP and HMP) that require
+// a confirmation in the interactive mode, unless the list is set
+// in the configuration file (see dangerousFile).
+var defaultDangerous = []string{
+	"blockdev-del",
+	"device_del",
+	"drive_del",
+	"netdev_del",
+	"object-del",
+	"q",
+	"quit",
+	"system_powerdown",
+	"system_reset",
+}
+
+// dangerousFile returns the path of the file with the list
+// of the commands that require a confirmation.
+func dangerousFile() (string, bool) {
+	dir, ok := configDir()
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(dir, "dangerous"), true
+}
+
+// loadDangerous reads the command names from the file, one per line.
+// Empty lines and lines starting with "#" are skipped.
+// If the file does not exist, nil is returned.
+func loadDangerous(fname string) ([]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	names := []string{}
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			names = append(names, line)
+		}
+	}
+
+	return names, scanner.Err()
+}
+
+func (s *QMPShell) isDangerous(name string) bool {
+	for _, n := range s.dangerous {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDangerous asks for a confirmation before sending
+// a dangerous command in the interactive mode. In the other modes
+// the command is refused if the safe mode is enabled.
+func (s *QMPShell) checkDangerous(cmd *QMPCommand) error {
+	name, desc := cmd.Name, ""
+
+	if cmd.Name == "human-monitor-command" {
+		args, _ := cmd.Arguments.(map[string]interface{})
+		cmdline, _ := args["command-line"].(string)
+		if fields := strings.Fields(cmdline); len(fields) > 0 {
+			name, desc = fields[0], cmdline
+		}
+	} else {
+		b, _ := json.Marshal(cmd.Arguments)
+		desc = cmd.Name + " " + string(b)
+	}
+
+	if !s.isDangerous(name) {
+		return nil
+	}
+
+	switch {
+	case !s.interactive && s.safe:
+		return fmt.Errorf("%s is in the list of dangerous commands, refusing to execute it in the safe mode", name)
+	case !s.interactive || !s.confirmDangerous:
+		return nil
+	}
+
+	ok, err := s.confirm("Execute " + desc + "?")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errCancelled
+	}
+
+	return nil
+}
+
+// confirm asks the yes/no question using the line editor.
+func (s *QMPShell) confirm(question string) (bool, error) {
+	v, err := s.line.Prompt(question + " [y/N] ")
+	if err != nil {
+		if err == liner.ErrPromptAborted {
+			return false, nil
+		}
+		return false, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "y", "yes":
+		return true, nil
+	}
+
+	return false, nil
+}
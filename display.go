@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+type pciDevice struct {
+	Bus       int `json:"bus"`
+	Slot      int `json:"slot"`
+	Function  int `json:"function"`
+	ClassInfo struct {
+		Desc  string `json:"desc"`
+		Class int    `json:"class"`
+	} `json:"class_info"`
+	ID struct {
+		Device int `json:"device"`
+		Vendor int `json:"vendor"`
+	} `json:"id"`
+	QdevID    string `json:"qdev_id"`
+	PCIBridge *struct {
+		Bus struct {
+			Secondary int `json:"secondary"`
+		} `json:"bus"`
+		Devices []pciDevice `json:"devices"`
+	} `json:"pci_bridge"`
+}
+
+// formatPCITree renders the output of query-pci as an indented tree:
+// bus -> slot -> function. Devices behind PCI bridges are shown
+// as nested buses under the bridge function.
+func formatPCITree(data []byte) string {
+	buses := []struct {
+		Bus     int         `json:"bus"`
+		Devices []pciDevice `json:"devices"`
+	}{}
+
+	if err := json.Unmarshal(data, &buses); err != nil {
+		return fmt.Sprintf("cannot parse query-pci output: %s", err)
+	}
+
+	var b strings.Builder
+
+	for _, bus := range buses {
+		writePCIBus(&b, bus.Bus, bus.Devices, 0)
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func writePCIBus(b *strings.Builder, bus int, devices []pciDevice, depth int) {
+	indent := strings.Repeat("      ", depth)
+
+	fmt.Fprintf(b, "%sbus %d\n", indent, bus)
+
+	for i, dev := range devices {
+		if i == 0 || devices[i-1].Slot != dev.Slot {
+			fmt.Fprintf(b, "%s  slot %d\n", indent, dev.Slot)
+		}
+
+		desc := dev.ClassInfo.Desc
+		if len(desc) == 0 {
+			desc = "Class"
+		}
+
+		fmt.Fprintf(b, "%s    function %d: %s [%04x] %04x:%04x", indent, dev.Function, desc, dev.ClassInfo.Class, dev.ID.Vendor, dev.ID.Device)
+		if len(dev.QdevID) > 0 {
+			fmt.Fprintf(b, " (%s)", dev.QdevID)
+		}
+		b.WriteString("\n")
+
+		if dev.PCIBridge != nil {
+			writePCIBus(b, dev.PCIBridge.Bus.Secondary, dev.PCIBridge.Devices, depth+1)
+		}
+	}
+}
+
+// pciTree implements the "pci-tree" command.
+func (s *QMPShell) pciTree(ctx context.Context, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: pci-tree")
+	}
+
+	var res json.RawMessage
+
+	if err := s.run(ctx, QMPCommand{"query-pci", nil}, &res); err != nil {
+		return "", err
+	}
+
+	return formatPCITree(res), nil
+}
+
+// formatTable renders rows as a table with aligned columns.
+// Only the columns listed in fields are shown (all if fields is empty).
+func formatTable(headers []string, rows [][]string, fields []string) (string, error) {
+	columns := make([]int, 0, len(headers))
+
+	if len(fields) == 0 {
+		for i := range headers {
+			columns = append(columns, i)
+		}
+	}
+
+	for _, f := range fields {
+		idx := -1
+		for i, h := range headers {
+			if h == f {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			return "", fmt.Errorf("unknown field: %s (available: %s)", f, strings.Join(headers, ", "))
+		}
+		columns = append(columns, idx)
+	}
+
+	var b strings.Builder
+
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+
+	writeRow := func(row []string) {
+		cells := make([]string, 0, len(columns))
+		for _, i := range columns {
+			cells = append(cells, row[i])
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+
+	upper := make([]string, 0, len(headers))
+	for _, h := range headers {
+		upper = append(upper, strings.ToUpper(h))
+	}
+
+	writeRow(upper)
+	for _, row := range rows {
+		writeRow(row)
+	}
+
+	w.Flush()
+
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// parseFieldsOption parses the "-fields a,b,c" (or "-fields=a,b,c")
+// option of the table commands.
+func parseFieldsOption(cmdname string, args []string) ([]string, error) {
+	switch {
+	case len(args) == 0:
+		return nil, nil
+	case len(args) == 2 && args[0] == "-fields":
+		return parseList(args[1]), nil
+	case len(args) == 1 && strings.HasPrefix(args[0], "-fields="):
+		return parseList(strings.TrimPrefix(args[0], "-fields=")), nil
+	}
+
+	return nil, fmt.Errorf("usage: %s [-fields <name1,name2,...>]", cmdname)
+}
+
+// blockList implements the "block-list" command.
+func (s *QMPShell) blockList(ctx context.Context, args []string) (string, error) {
+	fields, err := parseFieldsOption(args[0], args[1:])
+	if err != nil {
+		return "", err
+	}
+
+	devices := []struct {
+		Device   string `json:"device"`
+		IOStatus string `json:"io-status"`
+		Inserted *struct {
+			File string `json:"file"`
+			RO   bool   `json:"ro"`
+			Drv  string `json:"drv"`
+		} `json:"inserted"`
+	}{}
+
+	if err := s.run(ctx, QMPCommand{"query-block", nil}, &devices); err != nil {
+		return "", err
+	}
+
+	rows := make([][]string, 0, len(devices))
+
+	for _, d := range devices {
+		row := []string{d.Device, "-", "-", "-", d.IOStatus}
+		if d.Inserted != nil {
+			row[1] = d.Inserted.File
+			row[2] = fmt.Sprintf("%t", d.Inserted.RO)
+			row[3] = d.Inserted.Drv
+		}
+		if len(row[4]) == 0 {
+			row[4] = "-"
+		}
+		rows = append(rows, row)
+	}
+
+	return formatTable([]string{"device", "file", "ro", "drv", "io-status"}, rows, fields)
+}
+
+// netList implements the "net-list" command. It merges the output
+// of query-netdev (backends) and query-rx-filter (guest NICs),
+// and query-network-sriov if it is supported by QEMU.
+func (s *QMPShell) netList(ctx context.Context, args []string) (string, error) {
+	fields, err := parseFieldsOption(args[0], args[1:])
+	if err != nil {
+		return "", err
+	}
+
+	netdevs := []struct {
+		ID     string `json:"id"`
+		Type   string `json:"type"`
+		PeerID string `json:"peer-id"`
+	}{}
+
+	if s.hasCommand("query-netdev") {
+		if err := s.run(ctx, QMPCommand{"query-netdev", nil}, &netdevs); err != nil {
+			return "", err
+		}
+	}
+
+	nics := []struct {
+		Name    string `json:"name"`
+		MainMAC string `json:"main-mac"`
+	}{}
+
+	if err := s.run(ctx, QMPCommand{"query-rx-filter", nil}, &nics); err != nil {
+		return "", err
+	}
+
+	headers := []string{"name", "type", "peer", "mac"}
+
+	// Older QEMU versions do not support SR-IOV,
+	// so the column is shown only if available
+	var sriov map[string]struct{}
+
+	if s.hasCommand("query-network-sriov") {
+		devices := []struct {
+			Name string `json:"name"`
+		}{}
+
+		if err := s.run(ctx, QMPCommand{"query-network-sriov", nil}, &devices); err != nil {
+			return "", err
+		}
+
+		sriov = make(map[string]struct{})
+		for _, d := range devices {
+			sriov[d.Name] = struct{}{}
+		}
+
+		headers = append(headers, "sriov")
+	}
+
+	var rows [][]string
+
+	addRow := func(name, typ, peer, mac string) {
+		row := []string{name, typ, peer, mac}
+		if sriov != nil {
+			_, ok := sriov[name]
+			row = append(row, fmt.Sprintf("%t", ok))
+		}
+		for i := range row {
+			if len(row[i]) == 0 {
+				row[i] = "-"
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	for _, nic := range nics {
+		var peer string
+		for _, nd := range netdevs {
+			if nd.PeerID == nic.Name {
+				peer = nd.ID
+			}
+		}
+		addRow(nic.Name, "nic", peer, nic.MainMAC)
+	}
+
+	for _, nd := range netdevs {
+		addRow(nd.ID, nd.Type, nd.PeerID, "")
+	}
+
+	return formatTable(headers, rows, fields)
+}
+
+type cpuInfo struct {
+	Index    int    `json:"cpu-index"`
+	ThreadID int    `json:"thread-id"`
+	State    string `json:"-"`
+	Props    struct {
+		SocketID int `json:"socket-id"`
+		CoreID   int `json:"core-id"`
+		ThreadID int `json:"thread-id"`
+	} `json:"props"`
+}
+
+// formatCPUTopology renders the list of vCPUs as a tree:
+// socket -> core -> thread.
+func formatCPUTopology(cpus []cpuInfo) string {
+	sort.Slice(cpus, func(i, j int) bool {
+		a, b := cpus[i].Props, cpus[j].Props
+		switch {
+		case a.SocketID != b.SocketID:
+			return a.SocketID < b.SocketID
+		case a.CoreID != b.CoreID:
+			return a.CoreID < b.CoreID
+		}
+		return a.ThreadID < b.ThreadID
+	})
+
+	var b strings.Builder
+
+	for i, cpu := range cpus {
+		newSocket := i == 0 || cpus[i-1].Props.SocketID != cpu.Props.SocketID
+
+		if newSocket {
+			fmt.Fprintf(&b, "socket %d\n", cpu.Props.SocketID)
+		}
+		if newSocket || cpus[i-1].Props.CoreID != cpu.Props.CoreID {
+			fmt.Fprintf(&b, "  core %d\n", cpu.Props.CoreID)
+		}
+
+		fmt.Fprintf(&b, "    thread %d: cpu %d, %s, host thread %d\n", cpu.Props.ThreadID, cpu.Index, cpu.State, cpu.ThreadID)
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// cpuInfo implements the "cpu-info" command.
+func (s *QMPShell) cpuInfo(ctx context.Context, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: cpu-info")
+	}
+
+	var cpus []cpuInfo
+
+	if s.hasCommand("query-cpus-fast") {
+		if err := s.run(ctx, QMPCommand{"query-cpus-fast", nil}, &cpus); err != nil {
+			return "", err
+		}
+
+		// query-cpus-fast does not interrupt vCPUs, so their
+		// halted state is unknown. Use the VM run state instead
+		status := struct {
+			Status string `json:"status"`
+		}{}
+
+		if err := s.run(ctx, QMPCommand{"query-status", nil}, &status); err != nil {
+			return "", err
+		}
+
+		for i := range cpus {
+			cpus[i].State = status.Status
+		}
+	} else {
+		// Older QEMU versions
+		oldcpus := []struct {
+			cpuInfo
+			Index    int  `json:"CPU"`
+			ThreadID int  `json:"thread_id"`
+			Halted   bool `json:"halted"`
+		}{}
+
+		if err := s.run(ctx, QMPCommand{"query-cpus", nil}, &oldcpus); err != nil {
+			return "", err
+		}
+
+		for _, c := range oldcpus {
+			cpu := c.cpuInfo
+			cpu.Index = c.Index
+			cpu.ThreadID = c.ThreadID
+			cpu.State = "running"
+			if c.Halted {
+				cpu.State = "halted"
+			}
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return formatCPUTopology(cpus), nil
+}
+
+// truncateStrings returns a copy of the unmarshaled JSON value
+// with all strings longer than max bytes truncated.
+// The original length is shown after the truncated string.
+func truncateStrings(v interface{}, max int) interface{} {
+	switch v := v.(type) {
+	case string:
+		if len(v) <= max {
+			return v
+		}
+		n := max
+		for n > 0 && !utf8.RuneStart(v[n]) {
+			n--
+		}
+		return fmt.Sprintf("%s...(truncated, %d bytes)", v[:n], len(v))
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[k] = truncateStrings(x, max)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, x := range v {
+			a[i] = truncateStrings(x, max)
+		}
+		return a
+	}
+
+	return v
+}
+
+// humanizeThreshold is the minimal integer value
+// that is annotated in the humanized output.
+const humanizeThreshold = 1 << 20
+
+var intLineRe = regexp.MustCompile(`^\s*(?:"[^"]*": )?(\d+),?$`)
+
+// humanizeSizes annotates large integers of the formatted JSON
+// document with a human-readable size, e.g. "4294967296 (4.0 GiB)".
+// The raw values are kept unchanged.
+func humanizeSizes(data string) string {
+	lines := strings.Split(data, "\n")
+
+	for i, line := range lines {
+		m := intLineRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if n, err := strconv.ParseUint(m[1], 10, 64); err == nil && n >= humanizeThreshold {
+			lines[i] = line + "  (" + formatBytes(n) + ")"
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// formatBytes returns the size in binary units, e.g. "1.5 MiB".
+func formatBytes(n uint64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for x := n / unit; x >= unit; x /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// percent returns done/total as a percentage string.
+func percent(done, total uint64) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%d%%", done*100/total)
+}
+
+// progressBar returns a progress bar of the given width
+// followed by the percentage, e.g. "[=====>    ] 54%".
+func progressBar(done, total uint64, width int) string {
+	var filled int
+	if total > 0 {
+		filled = int(done * uint64(width) / total)
+	}
+	if filled > width {
+		filled = width
+	}
+
+	bar := strings.Repeat("=", filled)
+	if filled < width {
+		bar += ">" + strings.Repeat(" ", width-filled-1)
+	}
+
+	return fmt.Sprintf("[%s] %s", bar, percent(done, total))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dumpInfo is the result of query-dump.
+type dumpInfo struct {
+	Status    string `json:"status"`
+	Completed uint64 `json:"completed"`
+	Total     uint64 `json:"total"`
+}
+
+// dumpCompletedEvent is the data of the DUMP_COMPLETED event.
+type dumpCompletedEvent struct {
+	Result dumpInfo `json:"result"`
+	Error  string   `json:"error"`
+}
+
+// dump implements the "dump <path> [format=<fmt>] [paging=true]" command
+// that runs dump-guest-memory. If QEMU supports it, the dump is detached
+// and its progress is shown until DUMP_COMPLETED is received. QEMU
+// cannot cancel a dump, so Ctrl-C only stops watching it.
+func (s *QMPShell) dump(ctx context.Context, args []string) (string, error) {
+	const usage = "usage: dump <path> [format=elf|kdump-zlib|kdump-lzo|kdump-snappy|win-dmp] [paging=true|false]"
+
+	if len(args) < 2 || strings.Contains(args[1], "=") {
+		return "", fmt.Errorf(usage)
+	}
+
+	path := expandPath(strings.Trim(args[1], "\"'"))
+
+	// QEMU runs in a different directory, so the path must be absolute.
+	// The path on a remote host is passed as is.
+	if s.tunnel == nil {
+		var err error
+		if path, err = filepath.Abs(path); err != nil {
+			return "", err
+		}
+	}
+
+	cmd, err := s.buildQMPCommand("dump-guest-memory paging=false " + strings.Join(args[2:], " "))
+	if err != nil {
+		return "", fmt.Errorf("%s\n%s", err, usage)
+	}
+
+	cmdargs := cmd.Arguments.(map[string]interface{})
+	cmdargs["protocol"] = "file:" + path
+
+	detach := s.schema != nil && s.schema.Argument("dump-guest-memory", "detach") != nil
+	if detach {
+		cmdargs["detach"] = true
+	}
+
+	if (s.validate || s.strict) && s.schema != nil {
+		if err := s.schema.validateArguments(cmd); err != nil {
+			return "", err
+		}
+	}
+
+	since := s.events.cursor()
+
+	if err := s.run(ctx, cmd, nil); err != nil {
+		return "", err
+	}
+
+	if !detach {
+		return fmt.Sprintf("the guest memory is dumped to %s", path), nil
+	}
+
+	return s.watchDump(ctx, path, since)
+}
+
+// watchDump polls query-dump showing the progress of the dump
+// until DUMP_COMPLETED is received or the dump is no longer active.
+func (s *QMPShell) watchDump(ctx context.Context, path string, since uint64) (string, error) {
+	tty := isatty(os.Stdout)
+
+	if tty {
+		defer fmt.Print("\r\x1b[K")
+	}
+
+	for {
+		events, _, _ := s.events.since(since)
+
+		for _, e := range events {
+			if e.Type != "DUMP_COMPLETED" {
+				continue
+			}
+			var data dumpCompletedEvent
+			if err := json.Unmarshal(e.Data, &data); err != nil {
+				return "", fmt.Errorf("invalid DUMP_COMPLETED event: %s", err)
+			}
+			if len(data.Error) > 0 {
+				return "", fmt.Errorf("the dump failed: %s", data.Error)
+			}
+			return fmt.Sprintf("the guest memory is dumped to %s (%s)", path, formatBytes(data.Result.Completed)), nil
+		}
+
+		var info dumpInfo
+
+		switch err := s.run(ctx, QMPCommand{"query-dump", nil}, &info); {
+		case err == ErrCommandInterrupted:
+			return "stopped watching, the dump is still running (QEMU cannot cancel it)", nil
+		case err != nil:
+			return "", err
+		}
+
+		switch info.Status {
+		case "completed":
+			return fmt.Sprintf("the guest memory is dumped to %s (%s)", path, formatBytes(info.Completed)), nil
+		case "failed":
+			return "", fmt.Errorf("the dump failed")
+		case "active":
+			if tty {
+				fmt.Printf("\r\x1b[Kdump: %s %s / %s", progressBar(info.Completed, info.Total, 30), formatBytes(info.Completed), formatBytes(info.Total))
+			}
+		}
+
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			return "stopped watching, the dump is still running (QEMU cannot cancel it)", nil
+		}
+	}
+}
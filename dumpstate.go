@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// stateQueries are the read-only commands whose results
+// are saved by dump-state.
+var stateQueries = []string{
+	"query-name",
+	"query-uuid",
+	"query-status",
+	"query-version",
+	"query-kvm",
+	"query-machines",
+	"query-cpus-fast",
+	"query-memory-size-summary",
+	"query-memory-devices",
+	"query-hotpluggable-cpus",
+	"query-block",
+	"query-named-block-nodes",
+	"query-blockstats",
+	"query-block-jobs",
+	"query-netdev",
+	"query-rx-filter",
+	"query-pci",
+	"query-chardev",
+	"query-vnc",
+	"query-spice",
+	"query-migrate",
+	"query-migrate-capabilities",
+	"query-migrate-parameters",
+	"query-iothreads",
+	"query-balloon",
+	"query-jobs",
+}
+
+// dumpState implements the "dump-state <file>" command. It runs
+// the commands of stateQueries supported by QEMU one by one
+// and writes their results to the file as a single JSON object
+// keyed by the command name. The commands that fail are skipped
+// with a warning.
+func (s *QMPShell) dumpState(ctx context.Context, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("usage: dump-state <file>")
+	}
+
+	state := make(map[string]json.RawMessage)
+
+	var skipped []string
+
+	for _, name := range stateQueries {
+		if !s.hasCommand(name) {
+			continue
+		}
+
+		var res json.RawMessage
+
+		switch err := s.run(ctx, QMPCommand{Name: name}, &res); {
+		case err == ErrConnectionClosed || ctx.Err() != nil:
+			return "", err
+		case err != nil:
+			Warning.Printf("%s: %s", name, err)
+			skipped = append(skipped, name)
+			continue
+		}
+
+		state[name] = res
+	}
+
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(args[1], append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+
+	msg := fmt.Sprintf("%s: %d queries saved", args[1], len(state))
+	if len(skipped) > 0 {
+		msg += fmt.Sprintf(" (failed: %s)", strings.Join(skipped, ", "))
+	}
+
+	return msg, nil
+}
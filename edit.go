@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode"
+)
+
+// editCommand opens the editor ($VISUAL, $EDITOR or vi)
+// on a temporary file with the given text and returns
+// the edited text as a single-line command.
+func editCommand(text string) (string, error) {
+	editor := os.Getenv("VISUAL")
+	if len(editor) == 0 {
+		editor = os.Getenv("EDITOR")
+	}
+	if len(editor) == 0 {
+		editor = "vi"
+	}
+
+	f, err := ioutil.TempFile("", "qmp-shell-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if len(text) > 0 {
+		text += "\n"
+	}
+
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	args := append(strings.Fields(editor), f.Name())
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor failed: %s", err)
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return joinLines(string(b)), nil
+}
+
+// joinLines replaces line breaks outside of JSON strings with spaces,
+// so that a command can be written on multiple lines. Whitespace
+// inside JSON values (but outside strings) is removed, since
+// the values of arguments cannot contain spaces.
+func joinLines(text string) string {
+	var b strings.Builder
+	var q quoteState
+	var depth int
+
+	for _, c := range text {
+		if !q.next(c) {
+			switch {
+			case c == '{' || c == '[':
+				depth++
+			case c == '}' || c == ']':
+				depth--
+			case depth > 0 && unicode.IsSpace(c):
+				continue
+			case c == '\n' || c == '\r':
+				c = ' '
+			}
+		}
+		b.WriteRune(c)
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// jsonDepth returns the nesting depth of JSON objects and arrays
+// at the end of the text. Brackets inside strings are ignored.
+func jsonDepth(text string) int {
+	var depth int
+	var q quoteState
+
+	for _, c := range text {
+		if q.next(c) {
+			continue
+		}
+
+		switch {
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+
+	return depth
+}
+
+// readContinuation reads the lines of a command split into several
+// lines (e.g. a pasted multi-line JSON value) until all JSON objects
+// and arrays are closed. The lines are joined into a single command.
+func (s *QMPShell) readContinuation(cmdline string) (string, error) {
+	for jsonDepth(cmdline) > 0 {
+		next, err := s.line.Prompt("... ")
+		if err != nil {
+			return "", err
+		}
+		cmdline += "\n" + next
+	}
+
+	return joinLines(cmdline), nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestJoinLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"query-status\n", "query-status"},
+		{"guest-exec args={\"path\": \"/bin/ls\",\n \"arg\": [\"-l\", \"a b\"]}", `guest-exec args={"path":"/bin/ls","arg":["-l","a b"]}`},
+		{"x args={'tag': 'hello world',\n 'b': 1}", `x args={'tag':'hello world','b':1}`},
+		{"x args={'it\\'s': \"a \\\" b\"}", `x args={'it\'s':"a \" b"}`},
+	}
+
+	for _, tt := range tests {
+		if got := joinLines(tt.text); got != tt.want {
+			t.Errorf("joinLines(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestJSONDepth(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"x args={'a': [1,", 2},
+		{"x args={'a}': \"]\"", 1},
+		{"x args={'it\\'s }': 1}", 0},
+	}
+
+	for _, tt := range tests {
+		if got := jsonDepth(tt.text); got != tt.want {
+			t.Errorf("jsonDepth(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/0xef53/go-qmp/v2"
+)
+
+// eventRingSize is the number of the latest events kept by the shell.
+const eventRingSize = 1000
+
+// eventRing is a bounded buffer of the events received by the monitor.
+// Each event gets a sequence number, so the readers keep their own
+// cursors and never miss or repeat events. When the buffer is full,
+// the oldest events are dropped.
+//
+// The monitor keeps only a few latest events and can only find them
+// by the time in seconds, so the ring takes the new ones from it
+// on each read and periodically (see pumpEvents), skipping the events
+// already taken by their timestamps (several events may have the same one).
+type eventRing struct {
+	mu     sync.Mutex
+	find   func(t string, after uint64) ([]qmp.Event, bool)
+	events []qmp.Event
+	head   int    // index of the oldest event
+	seq    uint64 // sequence number of the next event
+	added  chan struct{}
+
+	// Counters of the events by type, see stats
+	counts map[string]*eventStat
+
+	// Timestamp of the last taken events in microseconds
+	// and the number of the taken events with this timestamp
+	last     uint64
+	sameLast int
+}
+
+func newEventRing(size int, find func(t string, after uint64) ([]qmp.Event, bool)) *eventRing {
+	return &eventRing{
+		find:   find,
+		events: make([]qmp.Event, 0, size),
+		added:  make(chan struct{}),
+		counts: make(map[string]*eventStat),
+	}
+}
+
+// pull takes the new events from the monitor.
+func (r *eventRing) pull() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pullLocked()
+}
+
+func (r *eventRing) pullLocked() {
+	events, found := r.find("", r.last/1e6)
+	if !found {
+		return
+	}
+
+	var skipped int
+	var fresh []qmp.Event
+
+	prev, prevSame := r.last, r.sameLast
+
+	for _, e := range events {
+		ts := e.Timestamp.Seconds*1e6 + e.Timestamp.Microseconds
+		switch {
+		case ts < prev:
+			continue
+		case ts == prev && skipped < prevSame:
+			skipped++
+			continue
+		}
+		if ts == r.last {
+			r.sameLast++
+		} else {
+			r.last, r.sameLast = ts, 1
+		}
+		fresh = append(fresh, e)
+	}
+
+	r.push(fresh...)
+}
+
+// push appends the events dropping the oldest ones if necessary,
+// counts them and wakes up the waiters. r.mu must be held.
+func (r *eventRing) push(ee ...qmp.Event) {
+	if len(ee) == 0 {
+		return
+	}
+
+	for _, e := range ee {
+		if len(r.events) < cap(r.events) {
+			r.events = append(r.events, e)
+		} else {
+			r.events[r.head] = e
+			r.head = (r.head + 1) % len(r.events)
+		}
+		r.seq++
+
+		st, ok := r.counts[e.Type]
+		if !ok {
+			st = &eventStat{}
+			r.counts[e.Type] = st
+		}
+		st.count++
+		st.last = time.Unix(int64(e.Timestamp.Seconds), int64(e.Timestamp.Microseconds)*1000)
+	}
+
+	close(r.added)
+	r.added = make(chan struct{})
+}
+
+// cursor returns the sequence number of the next event,
+// i.e. the cursor that skips all received events.
+func (r *eventRing) cursor() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pullLocked()
+
+	return r.seq
+}
+
+// stats returns the number of the received events of each type
+// and the time of the last one. The events are counted when they
+// are taken from the monitor, so the ones that are already dropped
+// from the buffer or never read by anyone are counted as well.
+func (r *eventRing) stats() map[string]eventStat {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pullLocked()
+
+	stats := make(map[string]eventStat, len(r.counts))
+	for t, st := range r.counts {
+		stats[t] = *st
+	}
+
+	return stats
+}
+
+// since returns the events starting from the sequence number seq
+// and the cursor following them. dropped is the number of the events
+// after seq that are no longer in the buffer.
+func (r *eventRing) since(seq uint64) (events []qmp.Event, next uint64, dropped uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pullLocked()
+
+	return r.sinceLocked(seq)
+}
+
+func (r *eventRing) sinceLocked(seq uint64) ([]qmp.Event, uint64, uint64) {
+	var dropped uint64
+
+	first := r.seq - uint64(len(r.events))
+
+	switch {
+	case seq < first:
+		dropped = first - seq
+		seq = first
+	case seq > r.seq:
+		seq = r.seq
+	}
+
+	events := make([]qmp.Event, 0, r.seq-seq)
+
+	for i := seq - first; i < uint64(len(r.events)); i++ {
+		events = append(events, r.events[(r.head+int(i))%len(r.events)])
+	}
+
+	return events, r.seq, dropped
+}
+
+// wait waits for the first event of the type (of any type if empty)
+// starting from the sequence number seq. It returns the event
+// and the cursor following it. The last value is false
+// if the context is done before such an event is received.
+func (r *eventRing) wait(ctx context.Context, t string, seq uint64) (qmp.Event, uint64, bool) {
+	for {
+		r.mu.Lock()
+		r.pullLocked()
+		events, next, dropped := r.sinceLocked(seq)
+		added := r.added
+		r.mu.Unlock()
+
+		seq += dropped
+
+		for _, e := range events {
+			seq++
+			if len(t) == 0 || e.Type == t {
+				return e, seq, true
+			}
+		}
+		seq = next
+
+		select {
+		case <-added:
+		case <-ctx.Done():
+			return qmp.Event{}, seq, false
+		}
+	}
+}
+
+// pumpEvents takes the new events from the monitor with the given
+// interval until the shell is closed, so that they are not lost
+// during long idle periods and the waiters are woken up.
+func (s *QMPShell) pumpEvents(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.events.pull()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/0xef53/go-qmp/v2"
+)
+
+func testEvent(t string, sec, usec uint64) qmp.Event {
+	var e qmp.Event
+	e.Type = t
+	e.Timestamp.Seconds = sec
+	e.Timestamp.Microseconds = usec
+	return e
+}
+
+// fakeEventSource imitates the event buffer of the monitor:
+// it keeps the last few events and finds them by the time in seconds.
+type fakeEventSource struct {
+	events []qmp.Event
+	size   int
+}
+
+func (f *fakeEventSource) add(ee ...qmp.Event) {
+	f.events = append(f.events, ee...)
+	if len(f.events) > f.size {
+		f.events = f.events[len(f.events)-f.size:]
+	}
+}
+
+func (f *fakeEventSource) find(t string, after uint64) ([]qmp.Event, bool) {
+	var out []qmp.Event
+	for _, e := range f.events {
+		if e.Timestamp.Seconds >= after && (t == "" || e.Type == t) {
+			out = append(out, e)
+		}
+	}
+	return out, len(out) > 0
+}
+
+func eventTypes(events []qmp.Event) []string {
+	types := make([]string, 0, len(events))
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestEventRingPull(t *testing.T) {
+	src := &fakeEventSource{size: 100}
+	r := newEventRing(10, src.find)
+
+	// Several events with the same timestamp and in the same second
+	src.add(testEvent("A", 10, 5), testEvent("B", 10, 5), testEvent("C", 10, 7))
+
+	events, next, dropped := r.since(0)
+	if got := eventTypes(events); len(got) != 3 || got[0] != "A" || got[2] != "C" || next != 3 || dropped != 0 {
+		t.Fatalf("since(0) = %v, %d, %d, want [A B C], 3, 0", got, next, dropped)
+	}
+
+	// The events already taken must not be repeated
+	src.add(testEvent("D", 10, 7), testEvent("E", 11, 0))
+
+	events, next, _ = r.since(next)
+	if got := eventTypes(events); len(got) != 2 || got[0] != "D" || got[1] != "E" || next != 5 {
+		t.Fatalf("since(3) = %v, %d, want [D E], 5", got, next)
+	}
+
+	if events, _, _ = r.since(next); len(events) != 0 {
+		t.Fatalf("since(5) = %v, want no events", eventTypes(events))
+	}
+}
+
+func TestEventRingOverflow(t *testing.T) {
+	src := &fakeEventSource{size: 100}
+	r := newEventRing(3, src.find)
+
+	for i, name := range []string{"A", "B", "C", "D", "E"} {
+		src.add(testEvent(name, uint64(i), 0))
+	}
+
+	events, next, dropped := r.since(0)
+	if got := eventTypes(events); len(got) != 3 || got[0] != "C" || got[2] != "E" || next != 5 || dropped != 2 {
+		t.Fatalf("since(0) = %v, %d, %d, want [C D E], 5, 2", got, next, dropped)
+	}
+
+	if _, _, dropped = r.since(4); dropped != 0 {
+		t.Fatalf("since(4) dropped %d, want 0", dropped)
+	}
+}
+
+func TestEventRingWait(t *testing.T) {
+	src := &fakeEventSource{size: 100}
+	r := newEventRing(10, src.find)
+
+	src.add(testEvent("A", 1, 0), testEvent("B", 2, 0), testEvent("A", 3, 0))
+
+	e, next, ok := r.wait(context.Background(), "A", 1)
+	if !ok || e.Timestamp.Seconds != 3 || next != 3 {
+		t.Fatalf("wait(A, 1) = %s@%d, %d, %t, want A@3, 3, true", e.Type, e.Timestamp.Seconds, next, ok)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, _, ok := r.wait(ctx, "A", next); ok {
+		t.Fatalf("wait(A, 3) found an event, want timeout")
+	}
+}
+
+func TestEventRingStats(t *testing.T) {
+	src := &fakeEventSource{size: 100}
+	r := newEventRing(2, src.find)
+
+	src.add(testEvent("A", 1, 0), testEvent("B", 2, 0), testEvent("A", 3, 0), testEvent("A", 4, 0))
+
+	// All events are counted, though some of them are dropped
+	// from the buffer and none of them is read
+	stats := r.stats()
+	if a, b := stats["A"], stats["B"]; a.count != 3 || a.last.Unix() != 4 || b.count != 1 || b.last.Unix() != 2 {
+		t.Fatalf("stats() = %v, want A: 3 (last at 4), B: 1 (last at 2)", stats)
+	}
+
+	src.add(testEvent("B", 5, 0))
+	r.pull()
+
+	if st := r.stats()["B"]; st.count != 2 || st.last.Unix() != 5 {
+		t.Fatalf("stats()[B] = %v, want 2 (last at 5)", st)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/0xef53/go-qmp/v2"
+)
+
+type eventStat struct {
+	count int
+	last  time.Time
+}
+
+// showEvents prints the events received since the last call.
+// If quietEvents is true, nothing is printed, but the events
+// are still skipped, so they are not shown later.
+func (s *QMPShell) showEvents() {
+	events, next, dropped := s.events.since(s.eventSeq)
+	s.eventSeq = next
+
+	if dropped > 0 && !s.quietEvents {
+		fmt.Printf("%d event(s) dropped, only the last %d are kept\n", dropped, eventRingSize)
+	}
+
+	if s.quietEvents {
+		return
+	}
+
+	for _, e := range events {
+		fmt.Println(formatEvent(e))
+	}
+}
+
+func formatEvent(e qmp.Event) string {
+	return fmt.Sprintf(
+		"Received QMP Event %s: %v, Timestamp: seconds = %d, microseconds = %d",
+		e.Type,
+		e.Data,
+		e.Timestamp.Seconds,
+		e.Timestamp.Microseconds,
+	)
+}
+
+// eventStatsTable implements the "event-stats" command.
+// It shows how many events of each type were received
+// during the session and when the last one was received.
+func (s *QMPShell) eventStatsTable(ctx context.Context, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: event-stats")
+	}
+
+	stats := s.events.stats()
+
+	types := make([]string, 0, len(stats))
+	for t := range stats {
+		types = append(types, t)
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		a, b := stats[types[i]], stats[types[j]]
+		if a.count != b.count {
+			return a.count > b.count
+		}
+		return types[i] < types[j]
+	})
+
+	rows := make([][]string, 0, len(types))
+	for _, t := range types {
+		st := stats[t]
+		rows = append(rows, []string{t, fmt.Sprintf("%d", st.count), st.last.Format(time.RFC3339)})
+	}
+
+	return formatTable([]string{"event", "count", "last"}, rows, nil)
+}
+
+// waitEvent implements the "wait-event <type> [<timeout-seconds>]" command.
+// It waits for an event of the given type received after the previous
+// wait-event call (or after connecting), so an event that fired
+// before the command was entered is not missed.
+func (s *QMPShell) waitEvent(ctx context.Context, args []string) (string, error) {
+	waitCtx := ctx
+
+	switch len(args) {
+	case 2:
+	case 3:
+		secs, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || secs <= 0 {
+			return "", fmt.Errorf("invalid timeout: %s", args[2])
+		}
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, time.Duration(secs*float64(time.Second)))
+		defer cancel()
+	default:
+		return "", fmt.Errorf("usage: wait-event <type> [<timeout-seconds>]")
+	}
+
+	e, next, ok := s.events.wait(waitCtx, args[1], s.waitSeq)
+	if !ok {
+		if ctx.Err() != nil {
+			return "", ErrCommandInterrupted
+		}
+		return "", fmt.Errorf("timed out waiting for %s", args[1])
+	}
+
+	s.waitSeq = next
+
+	return formatEvent(e), nil
+}
+
+// StreamEvents writes the received events to w as compact JSON objects
+// (event, data and timestamp), one per line, until the context is done
+// or the connection is closed. In the latter case ErrConnectionClosed
+// is returned. If filter is not empty, only the events whose type
+// matches the glob pattern are written.
+func (s *QMPShell) StreamEvents(ctx context.Context, w io.Writer, filter string) error {
+	if _, err := filepath.Match(filter, ""); err != nil {
+		return fmt.Errorf("invalid event filter %q: %s", filter, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var closed int32
+
+	go func() {
+		if err := s.waitClosed(ctx); err != nil && ctx.Err() == nil {
+			atomic.StoreInt32(&closed, 1)
+			cancel()
+		}
+	}()
+
+	write := func(e qmp.Event) error {
+		if len(filter) > 0 {
+			if ok, _ := filepath.Match(filter, e.Type); !ok {
+				return nil
+			}
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+
+	var seq uint64
+
+	for {
+		e, next, ok := s.events.wait(ctx, "", seq)
+		if !ok {
+			break
+		}
+		seq = next
+		if err := write(e); err != nil {
+			return err
+		}
+	}
+
+	if atomic.LoadInt32(&closed) == 0 {
+		return nil
+	}
+
+	// The events received just before the connection was closed
+	events, _, _ := s.events.since(seq)
+	for _, e := range events {
+		if err := write(e); err != nil {
+			return err
+		}
+	}
+
+	return ErrConnectionClosed
+}
+
+// waitClosed blocks until the connection to the monitor is closed
+// or the context is done. The monitor cannot report it directly,
+// but it interrupts the waiting for events when the connection
+// is lost, so an event that is never sent is waited for.
+func (s *QMPShell) waitClosed(ctx context.Context) error {
+	_, err := s.monitor.GetEvents(ctx, "QMP_SHELL_CONNECTION_CLOSED", 0)
+	return err
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Output formats of the results, see formatResult.
+const (
+	outputJSON    = "json"
+	outputYAML    = "yaml"
+	outputCompact = "compact"
+	outputTable   = "table"
+	outputRaw     = "raw"
+)
+
+var outputFormats = []string{outputJSON, outputYAML, outputCompact, outputTable, outputRaw}
+
+// setFormat implements the ".format [json|yaml|compact|table|raw]"
+// command that shows or changes the output format of the results.
+func (s *QMPShell) setFormat(ctx context.Context, args []string) (string, error) {
+	switch len(args) {
+	case 1:
+	case 2:
+		if !isOutputFormat(args[1]) {
+			return "", fmt.Errorf("unknown format: %s (available: %s)", args[1], strings.Join(outputFormats, ", "))
+		}
+		s.format = args[1]
+	default:
+		return "", fmt.Errorf("usage: .format [%s]", strings.Join(outputFormats, "|"))
+	}
+
+	return "format " + s.format, nil
+}
+
+func isOutputFormat(name string) bool {
+	for _, f := range outputFormats {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// formatYAML renders the decoded JSON value as YAML. Strings
+// that could be taken for another type are quoted in the JSON
+// style, which is valid in YAML as well.
+func formatYAML(v interface{}) string {
+	var b strings.Builder
+
+	writeYAML(&b, v, 0)
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func writeYAML(b *strings.Builder, v interface{}, depth int) {
+	indent := strings.Repeat("  ", depth)
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString(indent + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.WriteString(indent + yamlScalar(k) + ":")
+			writeYAMLValue(b, v[k], depth)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(indent + "[]\n")
+			return
+		}
+		for _, item := range v {
+			if !yamlCollection(item) {
+				b.WriteString(indent + "-")
+				writeYAMLValue(b, item, depth)
+				continue
+			}
+			// The first line of the nested collection
+			// starts right after the dash
+			var sub strings.Builder
+			writeYAML(&sub, item, depth+1)
+			b.WriteString(indent + "- " + sub.String()[len(indent)+2:])
+		}
+	default:
+		b.WriteString(indent + yamlScalar(v) + "\n")
+	}
+}
+
+// yamlCollection reports whether the value is a non-empty object or array.
+func yamlCollection(v interface{}) bool {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		return len(c) > 0
+	case []interface{}:
+		return len(c) > 0
+	}
+	return false
+}
+
+// writeYAMLValue writes the value of a key or a list item:
+// scalars and empty collections on the same line,
+// other values indented on the next lines.
+func writeYAMLValue(b *strings.Builder, v interface{}, depth int) {
+	if !yamlCollection(v) {
+		b.WriteString(" " + yamlScalar(v) + "\n")
+		return
+	}
+
+	b.WriteString("\n")
+	writeYAML(b, v, depth+1)
+}
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		if yamlPlain(v) {
+			return v
+		}
+		q, _ := json.Marshal(v)
+		return string(q)
+	}
+
+	q, _ := json.Marshal(v)
+	return string(q)
+}
+
+// yamlPlain reports whether the string can be written without quotes.
+func yamlPlain(s string) bool {
+	if len(s) == 0 || strings.TrimSpace(s) != s {
+		return false
+	}
+
+	switch strings.ToLower(s) {
+	case "null", "~", "true", "false", "yes", "no", "on", "off", "y", "n":
+		return false
+	}
+
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return false
+	}
+
+	if strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") {
+		return false
+	}
+
+	for _, c := range s {
+		if c < ' ' || c == '\x7f' {
+			return false
+		}
+	}
+
+	return !strings.Contains(s, ": ") && !strings.Contains(s, " #")
+}
+
+// unwrapReturn returns the value of the "return" field if v
+// is a whole QMP response ({"return": ...}) rather than a result.
+func unwrapReturn(v interface{}) (interface{}, bool) {
+	if obj, ok := v.(map[string]interface{}); ok && len(obj) == 1 {
+		if ret, ok := obj["return"]; ok {
+			return ret, true
+		}
+	}
+	return v, false
+}
+
+// formatValueTable renders the decoded JSON value as a table:
+// an array of objects has a column for each key, an object
+// has a row for each key. Nested values are shown as compact JSON.
+// Other values are returned as compact JSON. The value may also
+// be wrapped in a QMP response (see unwrapReturn).
+func formatValueTable(v interface{}) (string, error) {
+	v, _ = unwrapReturn(v)
+
+	switch v := v.(type) {
+	case []interface{}:
+		var headers []string
+		seen := make(map[string]struct{})
+
+		for _, item := range v {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				return compactJSON(v), nil
+			}
+			for k := range obj {
+				if _, ok := seen[k]; !ok {
+					seen[k] = struct{}{}
+					headers = append(headers, k)
+				}
+			}
+		}
+
+		if len(headers) == 0 {
+			return compactJSON(v), nil
+		}
+
+		sort.Strings(headers)
+
+		rows := make([][]string, 0, len(v))
+		for _, item := range v {
+			obj := item.(map[string]interface{})
+			row := make([]string, 0, len(headers))
+			for _, h := range headers {
+				cell := "-"
+				if val, ok := obj[h]; ok {
+					cell = tableCell(val)
+				}
+				row = append(row, cell)
+			}
+			rows = append(rows, row)
+		}
+
+		return formatTable(headers, rows, nil)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		rows := make([][]string, 0, len(keys))
+		for _, k := range keys {
+			rows = append(rows, []string{k, tableCell(v[k])})
+		}
+
+		return formatTable([]string{"key", "value"}, rows, nil)
+	}
+
+	return compactJSON(v), nil
+}
+
+func tableCell(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return compactJSON(v)
+}
+
+func compactJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
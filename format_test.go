@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFormatYAML(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{
+			value: `{"running": true, "status": "running", "singlestep": false}`,
+			want:  "running: true\nsinglestep: false\nstatus: running",
+		},
+		{
+			value: `[{"device": "drive0", "inserted": {"ro": false, "file": "/var/lib/vm.qcow2"}, "tray": []}, {"device": "cd0"}]`,
+			want: "- device: drive0\n" +
+				"  inserted:\n" +
+				"    file: /var/lib/vm.qcow2\n" +
+				"    ro: false\n" +
+				"  tray: []\n" +
+				"- device: cd0",
+		},
+		{
+			value: `{"id": "123", "name": "", "note": "a: b", "size": 9007199254740993, "opt": null, "tags": ["on", "x"]}`,
+			want: "id: \"123\"\n" +
+				"name: \"\"\n" +
+				"note: \"a: b\"\n" +
+				"opt: null\n" +
+				"size: 9007199254740993\n" +
+				"tags:\n" +
+				"  - \"on\"\n" +
+				"  - x",
+		},
+		{
+			value: `{}`,
+			want:  "{}",
+		},
+	}
+
+	for _, tt := range tests {
+		var v interface{}
+		if err := decodeJSON([]byte(tt.value), &v); err != nil {
+			t.Fatal(err)
+		}
+		if got := formatYAML(v); got != tt.want {
+			t.Errorf("formatYAML(%s) =\n%s\nwant:\n%s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFormatValueTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{
+			name:  "array",
+			value: `[{"id": "net0", "up": true}, {"id": "disk0", "size": 1024}]`,
+			want: "ID     SIZE  UP\n" +
+				"net0   -     true\n" +
+				"disk0  1024  -",
+		},
+		{
+			name:  "wrapped-array",
+			value: `{"return": [{"id": "net0"}, {"id": "disk0"}]}`,
+			want:  "ID\nnet0\ndisk0",
+		},
+		{
+			name:  "object",
+			value: `{"status": "running", "vcpus": [0, 1]}`,
+			want: "KEY     VALUE\n" +
+				"status  running\n" +
+				"vcpus   [0,1]",
+		},
+		{
+			name:  "wrapped-object",
+			value: `{"return": {"name": "alice"}}`,
+			want:  "KEY   VALUE\nname  alice",
+		},
+		{
+			name:  "scalars",
+			value: `["a", 1, null]`,
+			want:  `["a",1,null]`,
+		},
+		{
+			name:  "mixed",
+			value: `[{"id": "net0"}, "x"]`,
+			want:  `[{"id":"net0"},"x"]`,
+		},
+		{
+			name:  "empty",
+			value: `[]`,
+			want:  `[]`,
+		},
+	}
+
+	for _, tt := range tests {
+		var v interface{}
+		if err := decodeJSON([]byte(tt.value), &v); err != nil {
+			t.Fatal(err)
+		}
+		got, err := formatValueTable(v)
+		if err != nil {
+			t.Errorf("%s: formatValueTable() error: %s", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: formatValueTable() =\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// historyEntry is an item of the history file in the JSON Lines format.
+type historyEntry struct {
+	Cmd  string `json:"cmd"`
+	TS   string `json:"ts,omitempty"`
+	Exit *int   `json:"exit,omitempty"`
+}
+
+// isJSONLHistory reports whether the history file is in the JSON Lines
+// format (one historyEntry per line) rather than in the plain format.
+func isJSONLHistory(histfile string) bool {
+	return filepath.Ext(histfile) == ".jsonl"
+}
+
+func (s *QMPShell) LoadHistory(histfile string) error {
+	f, err := os.Open(histfile)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("reading history file: %s", err)
+	}
+	defer f.Close()
+
+	if isJSONLHistory(histfile) {
+		if err := s.readJSONLHistory(f); err != nil {
+			return fmt.Errorf("reading history file: %s", err)
+		}
+		return nil
+	}
+
+	s.line.ReadHistory(f)
+
+	return nil
+}
+
+// readJSONLHistory loads the history in the JSON Lines format.
+// Only the commands go to the line editor, the rest is kept
+// in histMeta to be written back on save. Lines that are not
+// JSON objects are taken as plain commands, so a plain history
+// file can be converted by just renaming it.
+func (s *QMPShell) readJSONLHistory(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		var e historyEntry
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &e) != nil {
+			e = historyEntry{Cmd: line}
+		}
+		if len(e.Cmd) == 0 {
+			continue
+		}
+
+		s.line.AppendHistory(e.Cmd)
+		s.histMeta[e.Cmd] = e
+	}
+
+	return scanner.Err()
+}
+
+// defaultHistIgnore is a list of argument names. Command lines
+// containing such arguments are not recorded to the history.
+var defaultHistIgnore = []string{"password", "secret", "key-secret"}
+
+// privateCommands are the QMP and HMP commands that are never
+// recorded to the history, since they take a password as an argument
+// without a name (e.g. "set_password vnc secret" in HMP).
+var privateCommands = []string{"set_password", "change-vnc-password", "change vnc password"}
+
+// recordHistory appends the executed command line to the history
+// (and saves the history file) unless the history is disabled
+// or the command line contains sensitive arguments. The time
+// and the exit code (see commandExitCode) are saved only
+// to the JSON Lines history files.
+func (s *QMPShell) recordHistory(cmdline string, err error) {
+	if !s.histEnabled || s.isPrivate(cmdline) {
+		return
+	}
+
+	s.line.AppendHistory(cmdline)
+
+	code := ExitOK
+	if err != nil {
+		code = commandExitCode(err)
+	}
+
+	s.histMu.Lock()
+	s.histMeta[cmdline] = historyEntry{
+		Cmd:  cmdline,
+		TS:   time.Now().UTC().Format(time.RFC3339),
+		Exit: &code,
+	}
+	s.histMu.Unlock()
+
+	if len(s.histfile) > 0 {
+		if err := s.SaveHistory(s.histfile); err != nil {
+			Error.Println(err)
+		}
+	}
+}
+
+// isPrivate returns true if the command line runs one of the
+// privateCommands or contains an argument whose name is in
+// the histignore list. The keys of JSON values are checked as well.
+func (s *QMPShell) isPrivate(cmdline string) bool {
+	line := cmdline
+	if hmpline, ok := s.hmpCommandLine(cmdline); ok {
+		line = hmpline
+	}
+
+	fields := strings.Fields(line)
+
+	for _, c := range privateCommands {
+		words := strings.Fields(c)
+		if len(fields) >= len(words) && strings.Join(fields[:len(words)], " ") == c {
+			return true
+		}
+	}
+
+	ignored := func(name string) bool {
+		for _, n := range s.histIgnore {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	var hasIgnoredKey func(v interface{}) bool
+
+	hasIgnoredKey = func(v interface{}) bool {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				if ignored(key) || hasIgnoredKey(value) {
+					return true
+				}
+			}
+		case []interface{}:
+			for _, value := range v {
+				if hasIgnoredKey(value) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, arg := range s.splitString(cmdline, ' ') {
+		parts := s.splitString(arg, '=')
+		if len(parts) == 0 {
+			continue
+		}
+		if ignored(parts[0]) {
+			return true
+		}
+		if len(parts) == 2 {
+			var value interface{}
+			if json.Unmarshal([]byte(strings.Trim(parts[1], "'")), &value) == nil && hasIgnoredKey(value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// SetHistoryFile sets the file to which the history is saved
+// after each accepted command, so that it is not lost
+// if the shell is terminated abnormally.
+func (s *QMPShell) SetHistoryFile(histfile string) {
+	s.histfile = histfile
+}
+
+func (s *QMPShell) SaveHistory(histfile string) error {
+	s.histMu.Lock()
+	defer s.histMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(histfile), 0755); err != nil {
+		return fmt.Errorf("writing history file: %s", err)
+	}
+
+	var buf bytes.Buffer
+
+	s.line.WriteHistory(&buf)
+
+	f, err := os.Create(histfile)
+	if err != nil {
+		return fmt.Errorf("writing history file: %s", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	for _, item := range compactHistory(strings.Split(buf.String(), "\n"), s.histDedup, s.histSize) {
+		if !isJSONLHistory(histfile) {
+			fmt.Fprintln(w, item)
+			continue
+		}
+
+		// The metadata is kept per command line, so repeated
+		// commands get the time and the exit code of the last run
+		e, ok := s.histMeta[item]
+		if !ok {
+			e = historyEntry{Cmd: item}
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("writing history file: %s", err)
+		}
+		fmt.Fprintln(w, string(b))
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("writing history file: %s", err)
+	}
+
+	if s.histMaxBytes > 0 {
+		if err := trimHistoryFile(histfile, s.histMaxBytes); err != nil {
+			return fmt.Errorf("trimming history file: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// trimHistoryFile drops the oldest lines of the history file
+// until its size fits into maxbytes.
+func trimHistoryFile(histfile string, maxbytes int64) error {
+	fi, err := os.Stat(histfile)
+	if err != nil {
+		return err
+	}
+	if fi.Size() <= maxbytes {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(histfile)
+	if err != nil {
+		return err
+	}
+
+	for int64(len(data)) > maxbytes {
+		idx := bytes.IndexByte(data, '\n')
+		if idx == -1 {
+			// A single line that does not fit
+			data = nil
+			break
+		}
+		data = data[idx+1:]
+	}
+
+	return ioutil.WriteFile(histfile, data, fi.Mode())
+}
+
+// compactHistory collapses consecutive duplicates and empty lines
+// in the history and truncates it to the maxsize last items.
+// If dedup is true, all duplicates are removed keeping
+// the most recent occurrence.
+func compactHistory(items []string, dedup bool, maxsize int) []string {
+	out := make([]string, 0, len(items))
+	seen := make(map[string]struct{})
+
+	// Walking backwards to keep the most recent occurrences
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+
+		if len(item) == 0 || (i > 0 && items[i-1] == item) {
+			continue
+		}
+		if dedup {
+			if _, ok := seen[item]; ok {
+				continue
+			}
+			seen[item] = struct{}{}
+		}
+
+		out = append(out, item)
+	}
+
+	if len(out) > maxsize {
+		out = out[:maxsize]
+	}
+
+	// Restoring the original order
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+
+	return out
+}
+
+// stateDir returns the directory where the history files are stored:
+// $XDG_STATE_HOME/qmp-shell or ~/.local/state/qmp-shell.
+func stateDir() (string, bool) {
+	return xdgDir("XDG_STATE_HOME", filepath.Join(".local", "state"))
+}
+
+// configDir returns the directory where the configuration files are stored:
+// $XDG_CONFIG_HOME/qmp-shell or ~/.config/qmp-shell.
+func configDir() (string, bool) {
+	return xdgDir("XDG_CONFIG_HOME", ".config")
+}
+
+func xdgDir(envname, fallback string) (string, bool) {
+	// According to the specification relative paths should be ignored
+	if dir := os.Getenv(envname); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "qmp-shell"), true
+	}
+
+	if homedir, isSet := os.LookupEnv("HOME"); isSet {
+		return filepath.Join(homedir, fallback, "qmp-shell"), true
+	}
+
+	return "", false
+}
+
+// historyFiles returns the list of history files that should be loaded
+// and the file to which the history should be saved.
+//
+// By default each VM has its own history file in the state directory:
+// qmp_history.d/<VM name> (or hmp_history.d/<VM name> for the HMP mode).
+// The shared file qmp_history (hmp_history) is used when the VM name
+// is empty or cannot be used as a file name ("." or "..").
+//
+// If the file does not exist yet, the shared file and the files
+// from the legacy locations (~/.qmpshell_history, ~/.hmpshell_history)
+// are loaded instead.
+func historyFiles(hmpMode bool, vmname string) ([]string, string) {
+	mode := "qmp"
+	if hmpMode {
+		mode = "hmp"
+	}
+
+	dir, ok := stateDir()
+	if !ok {
+		return nil, "/dev/null"
+	}
+
+	shared := filepath.Join(dir, mode+"_history")
+	legacy := filepath.Join(os.Getenv("HOME"), "."+mode+"shell_history")
+
+	histfile := shared
+
+	// The VM name may contain any characters,
+	// so make it safe to use as a file name.
+	// The names "." and ".." are not, the shared file is used then
+	vmfile := strings.Replace(vmname, string(filepath.Separator), "_", -1)
+	if vmfile == "." || vmfile == ".." {
+		vmfile = ""
+	}
+
+	if len(vmfile) > 0 {
+		histfile = filepath.Join(shared+".d", vmfile)
+	}
+
+	if fileExists(histfile) {
+		return []string{histfile}, histfile
+	}
+
+	var histfiles []string
+
+	for _, fname := range []string{legacy, filepath.Join(legacy+".d", vmfile)} {
+		if len(vmfile) == 0 && fname != legacy {
+			continue
+		}
+		if fileExists(fname) {
+			Warning.Printf("the history is now stored in %s (imported from %s)", histfile, fname)
+			histfiles = append(histfiles, fname)
+		}
+	}
+
+	if histfile != shared {
+		histfiles = append(histfiles, shared)
+	}
+
+	return append(histfiles, histfile), histfile
+}
+
+func fileExists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
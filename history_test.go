@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIsPrivate(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		isHMP   bool
+		want    bool
+	}{
+		{"query-status", false, false},
+		{"set_password protocol=vnc password=secret", false, true},
+		{"change-vnc-password password=secret", false, true},
+		{"object-add qom-type=secret id=sec0 data=secret", false, false},
+		{`blockdev-add options={"driver":"luks","key-secret":"sec0"}`, false, true},
+		{"hmp set_password vnc secret", false, true},
+		{"hmp change vnc password secret", false, true},
+		{"hmp change ide1-cd0 /tmp/cd.iso", false, false},
+		{"set_password vnc secret", true, true},
+		{"  set_password  vnc secret", true, true},
+		{"info status", true, false},
+	}
+
+	for _, tt := range tests {
+		s := &QMPShell{isHMP: tt.isHMP, histIgnore: defaultHistIgnore}
+		if got := s.isPrivate(tt.cmdline); got != tt.want {
+			t.Errorf("isPrivate(%q) with isHMP=%t = %t, want %t", tt.cmdline, tt.isHMP, got, tt.want)
+		}
+	}
+}
+
+// setenv sets the environment variable and returns
+// a function that restores its previous value.
+func setenv(name, value string) func() {
+	old, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+
+	return func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestHistoryFilesVMName(t *testing.T) {
+	defer setenv("XDG_STATE_HOME", "/state")()
+	defer setenv("HOME", "/nonexistent")()
+
+	tests := []struct {
+		vmname string
+		want   string
+	}{
+		{"alice", "/state/qmp-shell/qmp_history.d/alice"},
+		{"a/b", "/state/qmp-shell/qmp_history.d/a_b"},
+		{"..", "/state/qmp-shell/qmp_history"},
+		{".", "/state/qmp-shell/qmp_history"},
+		{"", "/state/qmp-shell/qmp_history"},
+	}
+
+	for _, tt := range tests {
+		if _, got := historyFiles(false, tt.vmname); got != tt.want {
+			t.Errorf("historyFiles(%q) = %q, want %q", tt.vmname, got, tt.want)
+		}
+	}
+}
+
+func TestSetHistSize(t *testing.T) {
+	s := new(QMPShell)
+	opt := shellOptions["histsize"]
+
+	if err := opt.Set(s, "500"); err != nil || s.histSize != 500 {
+		t.Fatalf("set histsize 500: error %v, histsize %d", err, s.histSize)
+	}
+
+	// liner keeps at most HistoryLimit entries
+	for _, v := range []string{"1001", "5000", "-1"} {
+		if err := opt.Set(s, v); err == nil || s.histSize != 500 {
+			t.Errorf("set histsize %s: error %v, histsize %d, want an error and 500", v, err, s.histSize)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hmpDeviceCommands is a list of HMP commands whose first positional
+// argument is a device or drive name.
+var hmpDeviceCommands = map[string]struct{}{
+	"block_resize":          struct{}{},
+	"block_set_io_throttle": struct{}{},
+	"change":                struct{}{},
+	"device_del":            struct{}{},
+	"drive_del":             struct{}{},
+	"eject":                 struct{}{},
+}
+
+// hmpPrefix allows to run a single HMP command from the QMP shell.
+const hmpPrefix = "hmp "
+
+// hmpCommandLine returns the HMP command line to be wrapped
+// into human-monitor-command: the whole command line in the HMP mode
+// or the part after hmpPrefix in the QMP mode.
+func (s *QMPShell) hmpCommandLine(cmdline string) (string, bool) {
+	switch {
+	case s.isHMP:
+		return cmdline, true
+	case strings.HasPrefix(cmdline+" ", hmpPrefix):
+		return strings.TrimSpace(cmdline[len(hmpPrefix)-1:]), true
+	}
+	return "", false
+}
+
+// ParseHMPHelpOutput returns the sorted command names found
+// in the output of the HMP "help" command. For the commands
+// with an alias (e.g. "c|cont") the full name is returned.
+// An error is returned if the text contains no commands.
+func ParseHMPHelpOutput(helpText string) ([]string, error) {
+	seen := make(map[string]struct{})
+
+	for _, line := range strings.Split(helpText, "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		// Skip empty lines, continuation lines and the lines
+		// with the arguments of the previous command
+		if len(line) == 0 || line[0] == '[' || line[0] == '\t' || line[0] == ' ' {
+			continue
+		}
+
+		// Drop arguments and help text
+		name := strings.Fields(line)[0]
+
+		if strings.Contains(name, "|") {
+			// Command in the form 'foobar|f' or 'f|foobar',
+			// take the full name
+			nn := strings.Split(name, "|")
+			if len(nn[0]) == 1 {
+				name = nn[1]
+			} else {
+				name = nn[0]
+			}
+		}
+
+		seen[name] = struct{}{}
+	}
+
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("no commands found in the HMP help output")
+	}
+
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// parseHMPHelp returns the command names found in the output
+// of the HMP "help" command (see ParseHMPHelpOutput),
+// each also as "help <name>". The info subcommands
+// are added by parseHMPInfo.
+func parseHMPHelp(out string) []string {
+	names, _ := ParseHMPHelpOutput(out)
+
+	var cmdlist []string
+
+	for _, name := range names {
+		if name != "info" {
+			cmdlist = append(cmdlist, name, "help "+name)
+		}
+	}
+
+	return cmdlist
+}
+
+// parseHMPInfo returns the subcommands found in the output
+// of the HMP "info" command as "info <name>".
+func parseHMPInfo(out string) []string {
+	var cmdlist []string
+
+	for _, line := range strings.Split(out, "\r\n") {
+		if !(len(line) > 0 && len(strings.Fields(line)) >= 2) {
+			continue
+		}
+		cmdlist = append(cmdlist, "info "+strings.Fields(line)[1])
+	}
+
+	return cmdlist
+}
+
+// loadHMPCommands builds the HMP command list for the completion.
+// It runs in background, so the shell is usable (without
+// the completion) until the list is ready or if it failed.
+func (s *QMPShell) loadHMPCommands() {
+	var cmdlist []string
+
+	for _, c := range []struct {
+		cmdline string
+		parse   func(string) []string
+	}{
+		{"help", parseHMPHelp},
+		{"info", parseHMPInfo},
+	} {
+		start := time.Now()
+		out, err := s.monitor.RunHuman(c.cmdline)
+		debugCommand(QMPCommand{"human-monitor-command", map[string]string{"command-line": c.cmdline}}, start, err)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				// The shell is being closed
+			default:
+				s.notify(fmt.Sprintf("cannot build the HMP command list, completion is disabled: %s", err))
+			}
+			return
+		}
+		cmdlist = append(cmdlist, c.parse(out)...)
+	}
+
+	sort.Strings(cmdlist)
+
+	s.hmpMu.Lock()
+	s.hmpCommands = cmdlist
+	s.hmpMu.Unlock()
+}
+
+// hmpNamesTTL is how long the device and drive names
+// gathered for the completion are cached.
+const hmpNamesTTL = 5 * time.Second
+
+var (
+	infoBlockNameRe     = regexp.MustCompile(`^([^\s:]+?)(?: \(#[^)]*\))?:`)
+	infoBlockAttachedRe = regexp.MustCompile(`^\s+Attached to:\s+(\S+)`)
+	infoPCIIDRe         = regexp.MustCompile(`^\s*id "([^"]+)"`)
+)
+
+// parseInfoBlock returns the drive and device names found
+// in the output of the HMP "info block" command.
+func parseInfoBlock(out string) []string {
+	var names []string
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if m := infoBlockNameRe.FindStringSubmatch(line); m != nil {
+			names = append(names, m[1])
+			continue
+		}
+
+		if m := infoBlockAttachedRe.FindStringSubmatch(line); m != nil {
+			dev := m[1]
+			// The QOM path is shown for devices without an ID,
+			// but the ID can be found in the peripheral part of the path
+			if strings.HasPrefix(dev, "/") {
+				parts := strings.Split(dev, "/")
+				if len(parts) < 4 || parts[2] != "peripheral" {
+					continue
+				}
+				dev = parts[3]
+			}
+			names = append(names, dev)
+		}
+	}
+
+	return names
+}
+
+// parseInfoPCI returns the IDs of the devices found
+// in the output of the HMP "info pci" command.
+func parseInfoPCI(out string) []string {
+	var names []string
+
+	for _, line := range strings.Split(out, "\n") {
+		if m := infoPCIIDRe.FindStringSubmatch(strings.TrimRight(line, "\r")); m != nil {
+			names = append(names, m[1])
+		}
+	}
+
+	return names
+}
+
+// hmpDeviceNames returns the sorted list of device and drive names
+// of the VM. The list is cached for hmpNamesTTL.
+func (s *QMPShell) hmpDeviceNames() []string {
+	if time.Since(s.hmpNamesTime) < hmpNamesTTL {
+		return s.hmpNames
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 2*time.Second)
+	defer cancel()
+
+	seen := make(map[string]struct{})
+
+	for _, c := range []struct {
+		cmdline string
+		parse   func(string) []string
+	}{
+		{"info block", parseInfoBlock},
+		{"info pci", parseInfoPCI},
+	} {
+		var out string
+		cmd := QMPCommand{"human-monitor-command", map[string]string{"command-line": c.cmdline}}
+		if err := s.run(ctx, cmd, &out); err != nil {
+			continue
+		}
+		for _, n := range c.parse(out) {
+			seen[n] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	s.hmpNames, s.hmpNamesTime = names, time.Now()
+
+	return names
+}
+
+// completeHMP is a liner.WordCompleter for the HMP commands.
+// The command name (including "info" and "help" subcommands) is completed
+// from the command list, the first positional argument of the commands
+// from hmpDeviceCommands is completed as a device or drive name.
+func (s *QMPShell) completeHMP(line string, pos int) (string, []string, string) {
+	head, tail := string([]rune(line)[:pos]), string([]rune(line)[pos:])
+
+	idx := strings.LastIndexAny(head, " \t")
+	word := head[idx+1:]
+
+	fields := strings.Fields(head[:idx+1])
+
+	s.hmpMu.Lock()
+	cmdlist := s.hmpCommands
+	s.hmpMu.Unlock()
+
+	switch {
+	case len(fields) == 0:
+		return "", completeFromList(cmdlist, strings.ToLower(head)), tail
+	case len(fields) == 1 && (fields[0] == "info" || fields[0] == "help"):
+		return "", completeFromList(cmdlist, fields[0]+" "+strings.ToLower(word)), tail
+	}
+
+	if _, ok := hmpDeviceCommands[fields[0]]; !ok {
+		return head, nil, tail
+	}
+
+	// Options like "eject -f" are not counted as positional arguments
+	for _, f := range fields[1:] {
+		if !strings.HasPrefix(f, "-") {
+			return head, nil, tail
+		}
+	}
+	if strings.HasPrefix(word, "-") {
+		return head, nil, tail
+	}
+
+	return head[:idx+1], completeFromList(s.hmpDeviceNames(), word), tail
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInfoBlock(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{
+			name: "qemu-1.5",
+			out: "drive-virtio-disk0: removable=0 io-status=ok file=/var/lib/images/vm.qcow2 ro=0 drv=qcow2 encrypted=0 bps=0 bps_rd=0 bps_wr=0 iops=0 iops_rd=0 iops_wr=0\r\n" +
+				"drive-ide0-1-0: removable=1 locked=0 tray-open=0 io-status=ok [not inserted]\r\n",
+			want: []string{"drive-virtio-disk0", "drive-ide0-1-0"},
+		},
+		{
+			name: "qemu-2.12",
+			out: "drive-virtio-disk0 (#block146): /var/lib/images/vm.qcow2 (qcow2)\r\n" +
+				"    Cache mode:       writeback, direct\r\n" +
+				"\r\n" +
+				"ide1-cd0: [not inserted]\r\n" +
+				"    Removable device: not locked, tray closed\r\n" +
+				"\r\n" +
+				"floppy0: [not inserted]\r\n" +
+				"    Removable device: not locked, tray closed\r\n",
+			want: []string{"drive-virtio-disk0", "ide1-cd0", "floppy0"},
+		},
+		{
+			name: "qemu-6.2-blockdev",
+			out: "libvirt-1-format: /var/lib/images/vm.qcow2 (qcow2)\r\n" +
+				"    Attached to:      /machine/peripheral/virtio-disk0/virtio-backend\r\n" +
+				"    Cache mode:       writeback, direct\r\n" +
+				"\r\n" +
+				"cdrom0 (#block391): [not inserted]\r\n" +
+				"    Attached to:      ide0-cd0\r\n" +
+				"    Removable device: not locked, tray closed\r\n" +
+				"\r\n" +
+				"drive1: /tmp/disk.raw (raw)\r\n" +
+				"    Attached to:      /machine/peripheral-anon/device[1]/virtio-backend\r\n",
+			want: []string{"libvirt-1-format", "virtio-disk0", "cdrom0", "ide0-cd0", "drive1"},
+		},
+		{
+			name: "empty",
+			out:  "",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := parseInfoBlock(tt.out); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseInfoBlock() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseInfoPCI(t *testing.T) {
+	out := strings.Join([]string{
+		"  Bus  0, device   0, function 0:",
+		"    Host bridge: PCI device 8086:1237",
+		"      PCI subsystem 1af4:1100",
+		"      id \"\"",
+		"  Bus  0, device   3, function 0:",
+		"    Ethernet controller: PCI device 1af4:1000",
+		"      PCI subsystem 1af4:0001",
+		"      IRQ 11, pin A",
+		"      BAR0: I/O at 0xc000 [0xc01f].",
+		"      id \"net0\"",
+		"  Bus  0, device   4, function 0:",
+		"    SCSI controller: PCI device 1af4:1001",
+		"      id \"virtio-disk0\"",
+		"",
+	}, "\r\n")
+
+	want := []string{"net0", "virtio-disk0"}
+
+	if got := parseInfoPCI(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseInfoPCI() = %q, want %q", got, want)
+	}
+}
+
+func TestParseHMPHelpOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{
+			name: "qemu-1.5",
+			out: "acl_add aclname match allow|deny [index] -- add a match rule to the access control list\r\n" +
+				"balloon target -- request VM to change its memory allocation (in MB)\r\n" +
+				"c|cont  -- resume emulation\r\n" +
+				"info [subcommand] -- show various information about the system state\r\n" +
+				"q|quit  -- quit the emulator\r\n" +
+				"x /fmt addr -- virtual memory dump starting at 'addr'\r\n",
+			want: []string{"acl_add", "balloon", "cont", "info", "quit", "x"},
+		},
+		{
+			name: "qemu-2.12",
+			out: "block_job_cancel [-f] device -- stop an active background block operation (use -f\r\n" +
+				"\t\t\t if the operation is currently paused)\r\n" +
+				"device_add driver[,prop=value][,...] -- add device, like -device on the command line\r\n" +
+				"gdbserver [device] -- start gdbserver on given device (default 'tcp::1234'), stop with 'none'\r\n" +
+				"set_link name on|off -- change the link status of a network adapter\r\n" +
+				"stopcapture capture index -- stop capture\r\n",
+			want: []string{"block_job_cancel", "device_add", "gdbserver", "set_link", "stopcapture"},
+		},
+		{
+			name: "qemu-6.2",
+			out: "announce_self [interfaces] [id] -- Trigger GARP/RARP announcements\r\n" +
+				"calc_dirty_rate [-r] [-b] second [sample_pages_per_GB] -- start a round of guest dirty rate measurement (using -r to\n" +
+				"\t\t\t specify dirty ring mode; using -b to specify dirty bitmap mode)\r\n" +
+				"help|? [cmd] -- show the help\r\n" +
+				"qom-list path -- list QOM properties\r\n" +
+				"savevm tag -- save a VM snapshot. If no tag is provided, a new snapshot is created\r\n" +
+				"\r\n",
+			want: []string{"announce_self", "calc_dirty_rate", "help", "qom-list", "savevm"},
+		},
+		{
+			name: "unix-newlines",
+			out:  "stop|s  -- stop emulation\nsystem_reset  -- reset the system\n",
+			want: []string{"stop", "system_reset"},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseHMPHelpOutput(tt.out)
+		if err != nil {
+			t.Errorf("%s: ParseHMPHelpOutput() error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseHMPHelpOutput() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := ParseHMPHelpOutput("\r\n\t\t\t continuation\r\n"); err == nil {
+		t.Errorf("ParseHMPHelpOutput(): expected an error for the output without commands")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/0xef53/go-qmp/v2"
+)
+
+const msgStoppedFollowing = "stopped following, the job is still running"
+
+// blockJob is an item of the query-block-jobs result.
+type blockJob struct {
+	Type   string `json:"type"`
+	Device string `json:"device"`
+	Len    uint64 `json:"len"`
+	Offset uint64 `json:"offset"`
+	Speed  uint64 `json:"speed"`
+	Paused bool   `json:"paused"`
+	Ready  bool   `json:"ready"`
+	Status string `json:"status"`
+}
+
+// state returns the job status. Older QEMU versions
+// do not report it, so it is derived from the flags.
+func (j *blockJob) state() string {
+	switch {
+	case len(j.Status) > 0:
+		return j.Status
+	case j.Ready:
+		return "ready"
+	case j.Paused:
+		return "paused"
+	}
+	return "running"
+}
+
+// blockJobEvent is the data of the BLOCK_JOB_* events.
+type blockJobEvent struct {
+	Device    string `json:"device"`
+	Operation string `json:"operation"`
+	Action    string `json:"action"`
+	Error     string `json:"error"`
+}
+
+// jobs implements the "jobs" and "jobs follow <device>" commands.
+func (s *QMPShell) jobs(ctx context.Context, args []string) (string, error) {
+	switch {
+	case len(args) == 1:
+		return s.jobList(ctx)
+	case len(args) == 3 && args[1] == "follow":
+		return s.followJob(ctx, args[2])
+	}
+
+	return "", fmt.Errorf("usage: jobs [follow <device>]")
+}
+
+// jobProgress implements the "job-progress" command that follows
+// the first block job that is not done yet (see followJob).
+func (s *QMPShell) jobProgress(ctx context.Context, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: job-progress")
+	}
+
+	jobs, err := s.queryBlockJobs(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, j := range jobs {
+		if j.Offset < j.Len {
+			return s.followJob(ctx, j.Device)
+		}
+	}
+
+	return "no block jobs in progress", nil
+}
+
+func (s *QMPShell) queryBlockJobs(ctx context.Context) ([]blockJob, error) {
+	var jobs []blockJob
+
+	if err := s.run(ctx, QMPCommand{"query-block-jobs", nil}, &jobs); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// jobList returns the table of the active block jobs.
+func (s *QMPShell) jobList(ctx context.Context) (string, error) {
+	jobs, err := s.queryBlockJobs(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if len(jobs) == 0 {
+		return "no active block jobs", nil
+	}
+
+	rows := make([][]string, 0, len(jobs))
+
+	for _, j := range jobs {
+		rows = append(rows, []string{
+			j.Device,
+			j.Type,
+			j.state(),
+			percent(j.Offset, j.Len),
+			fmt.Sprintf("%s / %s", formatBytes(j.Offset), formatBytes(j.Len)),
+			formatBytes(j.Speed) + "/s",
+		})
+	}
+
+	return formatTable([]string{"device", "type", "status", "progress", "done", "speed"}, rows, nil)
+}
+
+// followJob shows the progress of the block job until it becomes ready,
+// completes, fails or disappears. The BLOCK_JOB_* events of the job
+// are printed as they are received.
+func (s *QMPShell) followJob(ctx context.Context, device string) (string, error) {
+	// The progress bar is updated in place only on terminals
+	tty := isatty(os.Stdout)
+
+	// clear ends the progress line before printing anything else
+	var shown bool
+	clear := func() {
+		if shown {
+			fmt.Print("\r\x1b[K")
+			shown = false
+		}
+	}
+	defer clear()
+
+	after := s.events.cursor()
+
+	for first := true; ; first = false {
+		jobs, err := s.queryBlockJobs(ctx)
+		if err != nil {
+			if err == ErrCommandInterrupted {
+				return msgStoppedFollowing, nil
+			}
+			return "", err
+		}
+
+		var job *blockJob
+		for i := range jobs {
+			if jobs[i].Device == device {
+				job = &jobs[i]
+			}
+		}
+
+		switch {
+		case job == nil && first:
+			return "", fmt.Errorf("no such block job: %s", device)
+		case job == nil:
+			return fmt.Sprintf("%s: the job is finished", device), nil
+		case job.Ready:
+			return fmt.Sprintf("%s: %s job is ready to be completed", device, job.Type), nil
+		}
+
+		if tty {
+			fmt.Printf("\r\x1b[K%s: %s %s %s", device, job.Type, progressBar(job.Offset, job.Len, 30), job.state())
+			shown = true
+		}
+
+		// Waiting a second for the next poll, but checking
+		// the events more often to react to them promptly
+		for i := 0; i < 10; i++ {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
+				return msgStoppedFollowing, nil
+			}
+
+			var events []qmp.Event
+			if events, after, _ = s.events.since(after); len(events) == 0 {
+				continue
+			}
+
+			for _, e := range events {
+				msg, done := jobEventMessage(e, device)
+				if len(msg) == 0 {
+					continue
+				}
+				if done {
+					return msg, nil
+				}
+				clear()
+				fmt.Println(msg)
+			}
+		}
+	}
+}
+
+// jobEventMessage returns a message about the BLOCK_JOB_* event
+// of the given device and reports whether following the job
+// should be stopped (the job is over, ready or failed). An empty message is returned for other events.
+func jobEventMessage(e qmp.Event, device string) (string, bool) {
+	if !strings.HasPrefix(e.Type, "BLOCK_JOB_") {
+		return "", false
+	}
+
+	var data blockJobEvent
+	if err := json.Unmarshal(e.Data, &data); err != nil || data.Device != device {
+		return "", false
+	}
+
+	switch e.Type {
+	case "BLOCK_JOB_ERROR":
+		return fmt.Sprintf("%s: %s error, action: %s", device, data.Operation, data.Action), true
+	case "BLOCK_JOB_READY":
+		return fmt.Sprintf("%s: the job is ready to be completed", device), true
+	case "BLOCK_JOB_COMPLETED":
+		if len(data.Error) > 0 {
+			return fmt.Sprintf("%s: the job failed: %s", device, data.Error), true
+		}
+		return fmt.Sprintf("%s: the job is completed", device), true
+	case "BLOCK_JOB_CANCELLED":
+		return fmt.Sprintf("%s: the job is cancelled", device), true
+	}
+
+	return fmt.Sprintf("%s: %s", device, e.Type), false
+}
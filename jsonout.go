@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	qmp "github.com/0xef53/go-qmp/v2"
+)
+
+// shellErrorClass is the error class of the JSON records
+// for errors that occurred in the shell itself (e.g. parsing
+// or validation errors) rather than returned by QEMU.
+const shellErrorClass = "ShellError"
+
+// jsonRecord is the result of a command in the JSON output mode.
+type jsonRecord struct {
+	Command string            `json:"command"`
+	Result  json.RawMessage   `json:"result"`
+	Error   *qmp.GenericError `json:"error"`
+}
+
+// envelopeRecord is the result of a command in the envelope mode:
+// a self-describing record with the command sent to QEMU
+// (null for built-in commands and commands that failed to parse)
+// and the timing.
+type envelopeRecord struct {
+	Line       string            `json:"line"`
+	Command    *QMPCommand       `json:"command"`
+	Result     json.RawMessage   `json:"result"`
+	Error      *qmp.GenericError `json:"error"`
+	DurationMs float64           `json:"duration_ms"`
+	Timestamp  string            `json:"timestamp"`
+}
+
+// formatJSONRecord returns the result or the error of the command line
+// as a single-line JSON record (or envelopeRecord in the envelope mode).
+// Results that are not valid JSON (the HMP output or the output
+// of the built-in commands) are stored as strings.
+func (s *QMPShell) formatJSONRecord(cmdline, res string, err error) string {
+	_, isHMP := s.hmpCommandLine(cmdline)
+
+	var result json.RawMessage
+	var qmpErr *qmp.GenericError
+
+	switch {
+	case err != nil:
+		if e, ok := err.(*qmp.GenericError); ok {
+			qmpErr = e
+		} else {
+			qmpErr = &qmp.GenericError{Class: shellErrorClass, Desc: err.Error()}
+		}
+	case len(res) == 0:
+	case !isHMP && json.Valid([]byte(res)):
+		result = json.RawMessage(res)
+	default:
+		result, _ = json.Marshal(res)
+	}
+
+	var b []byte
+
+	if s.envelope {
+		elapsed := float64(time.Since(s.lastStart)) / float64(time.Millisecond)
+
+		b, _ = json.Marshal(envelopeRecord{
+			Line:       cmdline,
+			Command:    s.lastCommand,
+			Result:     result,
+			Error:      qmpErr,
+			DurationMs: math.Round(elapsed*1000) / 1000,
+			Timestamp:  s.lastStart.UTC().Format(time.RFC3339Nano),
+		})
+	} else {
+		b, _ = json.Marshal(jsonRecord{Command: cmdline, Result: result, Error: qmpErr})
+	}
+
+	return string(b)
+}
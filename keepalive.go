@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// keepalive periodically runs query-status to detect
+// a dead connection during long idle sessions. The reply
+// is awaited no longer than the interval, so a monitor that
+// stops answering without closing the socket is detected too.
+// On failure a notice is queued and the heartbeat stops.
+func (s *QMPShell) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// The monitor is busy with the abandoned command,
+		// which the user already knows about
+		if atomic.LoadInt32(&s.abandoned) > 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, interval)
+		err := s.run(ctx, QMPCommand{"query-status", nil}, nil)
+		cancel()
+
+		switch {
+		case err == nil:
+			continue
+		case s.ctx.Err() != nil:
+			// The shell is being closed
+		case err == ErrCommandTimeout:
+			s.notify(fmt.Sprintf("keepalive failed, no reply to query-status in %s: the monitor seems to be hung", interval))
+		default:
+			s.notify(fmt.Sprintf("keepalive failed, the connection seems to be dead: %s", err))
+		}
+		return
+	}
+}
+
+// notify queues a message that will be printed before the next prompt,
+// so that it does not interleave with the user input.
+func (s *QMPShell) notify(msg string) {
+	s.noticesMu.Lock()
+	defer s.noticesMu.Unlock()
+
+	s.notices = append(s.notices, msg)
+}
+
+// flushNotices prints all queued messages.
+func (s *QMPShell) flushNotices() {
+	s.noticesMu.Lock()
+	defer s.noticesMu.Unlock()
+
+	for _, msg := range s.notices {
+		Warning.Println(msg)
+	}
+
+	s.notices = nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Levels of the internal log messages, from the most severe one.
+const (
+	logError = "error"
+	logWarn  = "warn"
+	logInfo  = "info"
+	logDebug = "debug"
+)
+
+var logLevels = []string{logError, logWarn, logInfo, logDebug}
+
+// setLogLevel enables the loggers of the given level and the more
+// severe ones, the others are discarded. Errors are always printed.
+func setLogLevel(level string) error {
+	loggers := map[string]*log.Logger{
+		logWarn:  Warning,
+		logInfo:  Info,
+		logDebug: Debug,
+	}
+
+	var found bool
+
+	for _, l := range logLevels {
+		if logger, ok := loggers[l]; ok {
+			if found {
+				logger.SetOutput(ioutil.Discard)
+			} else {
+				logger.SetOutput(os.Stderr)
+			}
+		}
+		if l == level {
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("unknown log level: %s (available: %s)", level, strings.Join(logLevels, ", "))
+	}
+
+	return nil
+}
+
+// debugCommand logs the command sent to the monitor
+// with its duration and error at the debug level.
+func debugCommand(cmd interface{}, start time.Time, err error) {
+	if Debug.Writer() == ioutil.Discard {
+		return
+	}
+
+	b, _ := json.Marshal(cmd)
+
+	if err != nil {
+		Debug.Printf("%s: failed in %s: %s", b, time.Since(start), err)
+		return
+	}
+
+	Debug.Printf("%s: done in %s", b, time.Since(start))
+}
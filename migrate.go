@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const msgStoppedWatching = "stopped watching, the migration is still running"
+
+// migrationInfo is the part of the query-migrate result
+// shown by migrate-watch.
+type migrationInfo struct {
+	Status           string `json:"status"`
+	TotalTime        uint64 `json:"total-time"`
+	Downtime         uint64 `json:"downtime"`
+	ExpectedDowntime uint64 `json:"expected-downtime"`
+	ErrorDesc        string `json:"error-desc"`
+	RAM              *struct {
+		Transferred    uint64  `json:"transferred"`
+		Remaining      uint64  `json:"remaining"`
+		Total          uint64  `json:"total"`
+		DirtyPagesRate uint64  `json:"dirty-pages-rate"`
+		Mbps           float64 `json:"mbps"`
+	} `json:"ram"`
+}
+
+// finished reports whether the migration is over.
+func (m *migrationInfo) finished() bool {
+	switch m.Status {
+	case "completed", "failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+// statusLine returns a single-line summary of the migration progress.
+func (m *migrationInfo) statusLine() string {
+	parts := []string{m.Status}
+
+	if m.RAM != nil && m.RAM.Total > 0 {
+		parts = append(parts,
+			fmt.Sprintf("RAM %s / %s (%d%%)", formatBytes(m.RAM.Transferred), formatBytes(m.RAM.Total), 100*(m.RAM.Total-m.RAM.Remaining)/m.RAM.Total),
+			fmt.Sprintf("dirty %d pages/s", m.RAM.DirtyPagesRate),
+		)
+	}
+	if m.ExpectedDowntime > 0 {
+		parts = append(parts, fmt.Sprintf("downtime ~%d ms", m.ExpectedDowntime))
+	}
+	if m.RAM != nil {
+		parts = append(parts, fmt.Sprintf("%.1f Mbps", m.RAM.Mbps))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// summary returns the final result of the migration.
+func (m *migrationInfo) summary() string {
+	var rows [][]string
+
+	rows = append(rows, []string{"status:", m.Status})
+	if len(m.ErrorDesc) > 0 {
+		rows = append(rows, []string{"error:", m.ErrorDesc})
+	}
+	if m.TotalTime > 0 {
+		rows = append(rows, []string{"total time:", (time.Duration(m.TotalTime) * time.Millisecond).String()})
+	}
+	if m.Status == "completed" {
+		rows = append(rows, []string{"downtime:", fmt.Sprintf("%d ms", m.Downtime)})
+	}
+	if m.RAM != nil {
+		rows = append(rows,
+			[]string{"transferred:", formatBytes(m.RAM.Transferred)},
+			[]string{"throughput:", fmt.Sprintf("%.1f Mbps", m.RAM.Mbps)},
+		)
+	}
+
+	var b strings.Builder
+	for _, r := range rows {
+		fmt.Fprintf(&b, "%-13s%s\n", r[0], r[1])
+	}
+
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// migrateWatch implements the "migrate-watch" command. It polls
+// query-migrate every second (or as soon as a MIGRATION event
+// is received) and shows the progress in a single updating line
+// until the migration is over. Interrupting the command stops
+// watching, but does not cancel the migration.
+func (s *QMPShell) migrateWatch(ctx context.Context, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: migrate-watch")
+	}
+
+	// The status line is updated in place only on terminals
+	tty := isatty(os.Stdout)
+
+	after := s.events.cursor()
+
+	for first := true; ; first = false {
+		var info migrationInfo
+
+		if err := s.run(ctx, QMPCommand{"query-migrate", nil}, &info); err != nil {
+			if tty && !first {
+				fmt.Println()
+			}
+			if err == ErrCommandInterrupted {
+				return msgStoppedWatching, nil
+			}
+			return "", err
+		}
+
+		if first && (info.Status == "" || info.Status == "none") {
+			return "", fmt.Errorf("no migration in progress")
+		}
+
+		if info.finished() {
+			if tty && !first {
+				fmt.Print("\r\x1b[K")
+			}
+			return info.summary(), nil
+		}
+
+		if tty {
+			fmt.Print("\r\x1b[K" + info.statusLine())
+		}
+
+		// Waiting for the next poll or for a MIGRATION event,
+		// whichever comes first
+		evctx, cancel := context.WithTimeout(ctx, time.Second)
+		_, after, _ = s.events.wait(evctx, "MIGRATION", after)
+		cancel()
+
+		if ctx.Err() != nil {
+			if tty {
+				fmt.Println()
+			}
+			return msgStoppedWatching, nil
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const msgMirrorInterrupted = "interrupted, the mirror job is still running"
+
+// mirror implements the "mirror [--no-pivot] <device> <target> [args...]"
+// command that performs the whole drive-mirror sequence: starts
+// the job, waits for BLOCK_JOB_READY, issues block-job-complete
+// and waits for BLOCK_JOB_COMPLETED. With --no-pivot it stops
+// after the job is ready. The other arguments are passed
+// to drive-mirror (sync defaults to "full"), except ready-timeout
+// and complete-timeout that limit the waiting phases.
+func (s *QMPShell) mirror(ctx context.Context, args []string) (string, error) {
+	const usage = "usage: mirror [--no-pivot] <device> <target> [format=<fmt>] [sync=full|top|none] [ready-timeout=<duration>] [complete-timeout=<duration>] [<arg>=<value>...]"
+
+	pivot := true
+	if len(args) > 1 && args[1] == "--no-pivot" {
+		pivot = false
+		args = append(args[:1], args[2:]...)
+	}
+
+	if len(args) < 3 || strings.Contains(args[1], "=") || strings.Contains(args[2], "=") {
+		return "", fmt.Errorf(usage)
+	}
+
+	cmd, err := s.buildQMPCommand(fmt.Sprintf("drive-mirror device=%s target=%s %s", args[1], args[2], strings.Join(args[3:], " ")))
+	if err != nil {
+		return "", fmt.Errorf("%s\n%s", err, usage)
+	}
+
+	cmdargs := cmd.Arguments.(map[string]interface{})
+
+	if _, ok := cmdargs["sync"]; !ok {
+		cmdargs["sync"] = "full"
+	}
+
+	var timeouts [2]time.Duration
+
+	for i, name := range []string{"ready-timeout", "complete-timeout"} {
+		v, ok := cmdargs[name]
+		if !ok {
+			continue
+		}
+		delete(cmdargs, name)
+		d, err := time.ParseDuration(fmt.Sprint(v))
+		if err != nil || d <= 0 {
+			return "", fmt.Errorf("invalid %s: %v", name, v)
+		}
+		timeouts[i] = d
+	}
+
+	if (s.validate || s.strict) && s.schema != nil {
+		if err := s.schema.validateArguments(cmd); err != nil {
+			return "", err
+		}
+	}
+
+	// The job is identified by its ID, which is the device name by default
+	job := fmt.Sprint(cmdargs["device"])
+	if id, ok := cmdargs["job-id"]; ok {
+		job = fmt.Sprint(id)
+	}
+
+	// Events received before the job was started are ignored
+	since := s.events.cursor()
+
+	if err := s.run(ctx, cmd, nil); err != nil {
+		return "", fmt.Errorf("%s: start phase failed: %s", job, err)
+	}
+
+	fmt.Printf("%s: mirroring to %s\n", job, cmdargs["target"])
+
+	switch err := s.waitMirror(ctx, job, "BLOCK_JOB_READY", since, timeouts[0]); {
+	case err == ErrCommandInterrupted:
+		return msgMirrorInterrupted, nil
+	case err != nil:
+		return "", fmt.Errorf("%s: sync phase failed: %s", job, err)
+	}
+
+	if !pivot {
+		return fmt.Sprintf("%s: the job is ready, complete it using block-job-complete device=%s", job, job), nil
+	}
+
+	fmt.Printf("%s: the job is ready, pivoting to %s\n", job, cmdargs["target"])
+
+	if err := s.run(ctx, QMPCommand{"block-job-complete", map[string]string{"device": job}}, nil); err != nil {
+		return "", fmt.Errorf("%s: pivot phase failed: %s", job, err)
+	}
+
+	switch err := s.waitMirror(ctx, job, "BLOCK_JOB_COMPLETED", since, timeouts[1]); {
+	case err == ErrCommandInterrupted:
+		return msgMirrorInterrupted, nil
+	case err != nil:
+		return "", fmt.Errorf("%s: complete phase failed: %s", job, err)
+	}
+
+	return fmt.Sprintf("%s: the mirror is completed, the device now uses %s", job, cmdargs["target"]), nil
+}
+
+// waitMirror waits for the event (BLOCK_JOB_READY or BLOCK_JOB_COMPLETED)
+// of the job received after the given cursor, showing the progress
+// of the job on terminals. An error is returned if the job fails,
+// is cancelled or disappears, or if the timeout (if not zero) expires.
+func (s *QMPShell) waitMirror(ctx context.Context, job, event string, since uint64, timeout time.Duration) error {
+	tty := isatty(os.Stdout)
+
+	if tty {
+		defer fmt.Print("\r\x1b[K")
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	var gone bool
+
+	for {
+		// All events of the job are checked on each iteration,
+		// so none of them is missed between the polls
+		if events, _, _ := s.events.since(since); len(events) > 0 {
+			for _, e := range events {
+				if !strings.HasPrefix(e.Type, "BLOCK_JOB_") {
+					continue
+				}
+
+				var data blockJobEvent
+				if err := json.Unmarshal(e.Data, &data); err != nil || data.Device != job {
+					continue
+				}
+
+				switch {
+				case e.Type == "BLOCK_JOB_COMPLETED" && len(data.Error) > 0:
+					return fmt.Errorf("the job failed: %s", data.Error)
+				case e.Type == event:
+					return nil
+				case e.Type == "BLOCK_JOB_CANCELLED":
+					return fmt.Errorf("the job is cancelled")
+				case e.Type == "BLOCK_JOB_COMPLETED":
+					return fmt.Errorf("the job is completed unexpectedly")
+				case e.Type == "BLOCK_JOB_ERROR" && data.Action != "ignore":
+					return fmt.Errorf("%s error, action: %s", data.Operation, data.Action)
+				}
+			}
+		}
+
+		jobs, err := s.queryBlockJobs(ctx)
+		if err != nil {
+			return err
+		}
+
+		var j *blockJob
+		for i := range jobs {
+			if jobs[i].Device == job {
+				j = &jobs[i]
+			}
+		}
+
+		// The event may be received a bit later than the job
+		// disappears, so the events are checked once more
+		if j == nil {
+			if gone {
+				return fmt.Errorf("the job has disappeared")
+			}
+			gone = true
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
+				return ErrCommandInterrupted
+			}
+			continue
+		}
+
+		if tty {
+			fmt.Printf("\r\x1b[K%s: %s %s %s", job, j.Type, progressBar(j.Offset, j.Len, 30), j.state())
+		}
+
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-deadline:
+			return fmt.Errorf("timed out after %s waiting for %s", timeout, event)
+		case <-ctx.Done():
+			return ErrCommandInterrupted
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// caretError returns an error with the message followed by the line
+// and a caret under the byte at the given position of the line.
+func caretError(msg, line string, pos int) error {
+	if pos > len(line) {
+		pos = len(line)
+	}
+
+	return fmt.Errorf("%s\n  %s\n  %s^", msg, line, strings.Repeat(" ", utf8.RuneCountInString(line[:pos])))
+}
+
+// quoteState tracks the quoted strings while a command line is scanned.
+// It is shared by all the scanners of the command line (checkBalance,
+// splitChain, stripComment, jsonDepth, joinLines), so that they agree
+// on where the strings are. A backslash escapes the next character
+// in both double- and single-quoted strings, like in relaxJSON.
+type quoteState struct {
+	quote   rune
+	escaped bool
+}
+
+// next takes the next character of the line and returns true
+// if it is a part of a quoted string, including the quotes.
+func (q *quoteState) next(c rune) bool {
+	switch {
+	case q.escaped:
+		q.escaped = false
+	case q.quote != 0:
+		if c == '\\' {
+			q.escaped = true
+		} else if c == q.quote {
+			q.quote = 0
+		}
+	case c == '"' || c == '\'':
+		q.quote = c
+	default:
+		return false
+	}
+	return true
+}
+
+// checkBalance makes sure that all braces, brackets and quotes
+// of the command line are balanced.
+func checkBalance(cmdline string) error {
+	var stack []int
+	var q quoteState
+	var quotePos int
+
+	closers := map[byte]byte{'{': '}', '[': ']'}
+
+	for i := 0; i < len(cmdline); i++ {
+		c := cmdline[i]
+
+		opening := q.quote == 0
+		if q.next(rune(c)) {
+			if opening {
+				quotePos = i
+			}
+			continue
+		}
+
+		switch {
+		case c == '{' || c == '[':
+			stack = append(stack, i)
+		case c == '}' || c == ']':
+			if len(stack) == 0 {
+				return caretError(fmt.Sprintf("unexpected '%c'", c), cmdline, i)
+			}
+			open := stack[len(stack)-1]
+			if closers[cmdline[open]] != c {
+				return caretError(fmt.Sprintf("expected '%c' but found '%c'", closers[cmdline[open]], c), cmdline, i)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	switch {
+	case q.quote != 0:
+		return caretError("unterminated string", cmdline, quotePos)
+	case len(stack) > 0:
+		open := stack[len(stack)-1]
+		return caretError(fmt.Sprintf("unclosed '%c'", cmdline[open]), cmdline, open)
+	}
+
+	return nil
+}
+
+// jsonErrorOffset returns the position of the error
+// in the parsed JSON value or -1 if it is unknown.
+func jsonErrorOffset(err error) int {
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		return int(err.Offset) - 1
+	case *json.UnmarshalTypeError:
+		return int(err.Offset) - 1
+	}
+	return -1
+}
+
+// decodeJSON unmarshals the JSON data like json.Unmarshal, but numbers
+// are decoded as json.Number. So large integers (e.g. addresses
+// or sizes beyond 2^53) do not lose precision when the value
+// is marshaled back.
+func decodeJSON(data []byte, v interface{}) error {
+	// Unmarshal reports syntax errors (including trailing data)
+	// with their offsets, so it is used for validation
+	var raw json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	return dec.Decode(v)
+}
+
+// relaxJSON converts a relaxed JSON value to strict JSON: unquoted
+// object keys and single-quoted strings are enclosed in double quotes,
+// trailing commas in objects and arrays are removed. Other syntax
+// errors are left as is to be reported by the JSON parser.
+func relaxJSON(str string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+
+		switch {
+		case c == '"':
+			j, _ := stringEnd(str, i)
+			b.WriteString(str[i:j])
+			i = j - 1
+		case c == '\'':
+			j, closed := stringEnd(str, i)
+			inner := str[i+1 : j]
+			if closed {
+				inner = str[i+1 : j-1]
+			}
+			b.WriteByte('"')
+			for k := 0; k < len(inner); k++ {
+				switch {
+				case inner[k] == '\\' && k+1 < len(inner):
+					// A single quote needs no escaping in JSON
+					if inner[k+1] != '\'' {
+						b.WriteByte('\\')
+					}
+					b.WriteByte(inner[k+1])
+					k++
+				case inner[k] == '"':
+					b.WriteString(`\"`)
+				default:
+					b.WriteByte(inner[k])
+				}
+			}
+			if closed {
+				b.WriteByte('"')
+			}
+			i = j - 1
+		case c == ',':
+			k := i + 1
+			for k < len(str) && strings.IndexByte(" \t\r\n", str[k]) != -1 {
+				k++
+			}
+			if k < len(str) && (str[k] == '}' || str[k] == ']') {
+				continue
+			}
+			b.WriteByte(c)
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(str) && (isIdentStart(str[j]) || str[j] == '-' || (str[j] >= '0' && str[j] <= '9')) {
+				j++
+			}
+			k := j
+			for k < len(str) && strings.IndexByte(" \t\r\n", str[k]) != -1 {
+				k++
+			}
+			if k < len(str) && str[k] == ':' {
+				b.WriteString(strconv.Quote(str[i:j]))
+			} else {
+				b.WriteString(str[i:j])
+			}
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// stringEnd returns the position after the closing quote
+// of the string starting at str[i]. If the string is not closed,
+// len(str) and false are returned.
+func stringEnd(str string, i int) (int, bool) {
+	q := str[i]
+
+	for j := i + 1; j < len(str); j++ {
+		switch str[j] {
+		case '\\':
+			j++
+		case q:
+			return j + 1, true
+		}
+	}
+
+	return len(str), false
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+var envVarRe = regexp.MustCompile(`\$(?:\{(\w+)\}|(\w+))`)
+
+// expandPath expands a leading "~" or "~user" and the $VAR and ${VAR}
+// references in the path. Undefined variables and unknown users
+// are left as is.
+func expandPath(path string) string {
+	path = envVarRe.ReplaceAllStringFunc(path, func(ref string) string {
+		m := envVarRe.FindStringSubmatch(ref)
+		name := m[1] + m[2]
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		return ref
+	})
+
+	if !strings.HasPrefix(path, "~") {
+		return path
+	}
+
+	name, rest := path[1:], ""
+	if idx := strings.IndexByte(path, '/'); idx != -1 {
+		name, rest = path[1:idx], path[idx:]
+	}
+
+	var home string
+
+	if len(name) == 0 {
+		home = os.Getenv("HOME")
+	} else if u, err := user.Lookup(name); err == nil {
+		home = u.HomeDir
+	}
+
+	if len(home) == 0 {
+		return path
+	}
+
+	return home + rest
+}
+
+// timeoutArgRe matches the "@timeout=<duration>" argument.
+var timeoutArgRe = regexp.MustCompile(`(^|\s)@timeout=(\S*)`)
+
+// parseTimeoutOverride strips the timeout override of a single command
+// from the command line: either the "timeout <duration> " prefix
+// or the "@timeout=<duration>" argument. The duration is a Go duration
+// (e.g. "30s" or "30m") or "off" for no timeout. The third return
+// value is false if the command line has no override.
+func parseTimeoutOverride(cmdline string) (string, time.Duration, bool, error) {
+	var value string
+
+	if fields := strings.Fields(cmdline); len(fields) > 0 && fields[0] == "timeout" {
+		if len(fields) < 3 {
+			return "", 0, false, fmt.Errorf("usage: timeout <duration>|off <command> [args...]")
+		}
+		value = fields[1]
+		cmdline = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cmdline), "timeout"))
+		cmdline = strings.TrimSpace(cmdline[len(value):])
+	} else if m := timeoutArgRe.FindStringSubmatchIndex(cmdline); m != nil {
+		value = cmdline[m[4]:m[5]]
+		cmdline = strings.TrimSpace(cmdline[:m[0]] + cmdline[m[1]:])
+	} else {
+		return cmdline, 0, false, nil
+	}
+
+	if value == "off" {
+		return cmdline, 0, true, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return "", 0, false, fmt.Errorf("invalid timeout: %q", value)
+	}
+
+	return cmdline, d, true, nil
+}
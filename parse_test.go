@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDecodeJSONPrecision(t *testing.T) {
+	tests := []string{
+		`9007199254740993`,
+		`18446744073709551615`,
+		`-9223372036854775807`,
+		`{"addr":9007199254740993,"ratio":0.1,"size":18446744073709551615}`,
+		`[9007199254740993,{"node-id":9007199254740995}]`,
+	}
+
+	for _, data := range tests {
+		var v interface{}
+
+		if err := decodeJSON([]byte(data), &v); err != nil {
+			t.Errorf("decodeJSON(%s): unexpected error: %s", data, err)
+			continue
+		}
+
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Errorf("marshaling %s: unexpected error: %s", data, err)
+			continue
+		}
+
+		if string(b) != data {
+			t.Errorf("round-trip of %s: got %s", data, b)
+		}
+	}
+}
+
+func TestFormatResultPrecision(t *testing.T) {
+	var res interface{}
+
+	if err := decodeJSON([]byte(`{"size":9007199254740993}`), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := new(QMPShell).formatResult(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "{\n    \"size\": 9007199254740993\n}"; out != want {
+		t.Errorf("formatResult() = %q, want %q", out, want)
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	tests := []struct {
+		data   string
+		offset int
+	}{
+		{`{"a":1,}`, 7},
+		{`[1,2] 3`, 6},
+		{`{"a":[1,2}`, 9},
+	}
+
+	for _, tt := range tests {
+		var v interface{}
+
+		err := decodeJSON([]byte(tt.data), &v)
+		if err == nil {
+			t.Errorf("decodeJSON(%s): expected an error", tt.data)
+			continue
+		}
+
+		if offset := jsonErrorOffset(err); offset != tt.offset {
+			t.Errorf("decodeJSON(%s): error offset = %d, want %d", tt.data, offset, tt.offset)
+		}
+	}
+}
+
+func TestRelaxJSON(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`{"a":1}`, `{"a":1}`},
+		{`{key:1}`, `{"key":1}`},
+		{`{node-name:'disk0',read-only:true}`, `{"node-name":"disk0","read-only":true}`},
+		{`{a:'it\'s "x"'}`, `{"a":"it's \"x\""}`},
+		{`[1,2,]`, `[1,2]`},
+		{`{a:[1, {b:null,} ],}`, `{"a":[1, {"b":null} ]}`},
+		{`{"a:b":'c,}'}`, `{"a:b":"c,}"}`},
+		{`{a:'unclosed}`, `{"a":"unclosed}`},
+	}
+
+	for _, tt := range tests {
+		if got := relaxJSON(tt.in); got != tt.want {
+			t.Errorf("relaxJSON(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatReturnEmpty(t *testing.T) {
+	tests := []struct {
+		raw   string
+		quiet bool
+		mode  string
+		want  string
+	}{
+		{raw: `{}`, want: okResult},
+		{raw: `null`, want: okResult},
+		{raw: `{}`, quiet: true, want: ""},
+		{raw: `[]`, want: "[]"},
+		{raw: `{}`, mode: "raw", want: `{}`},
+		{raw: `null`, mode: "json", want: `null`},
+		{raw: `{"a":1}`, quiet: true, want: "{\n    \"a\": 1\n}"},
+	}
+
+	for _, tt := range tests {
+		s := QMPShell{quiet: tt.quiet, format: outputJSON, jsonOut: tt.mode == "json"}
+		if tt.mode == "raw" {
+			s.format = outputRaw
+		}
+
+		out, err := s.formatReturn("stop", json.RawMessage(tt.raw))
+		if err != nil {
+			t.Errorf("formatReturn(%s): unexpected error: %s", tt.raw, err)
+			continue
+		}
+
+		if out != tt.want {
+			t.Errorf("formatReturn(%s) with quiet=%t, mode=%q = %q, want %q", tt.raw, tt.quiet, tt.mode, out, tt.want)
+		}
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	defer setenv("HOME", "/home/alice")()
+	defer setenv("IMAGES", "/var/lib/images")()
+	os.Unsetenv("QMP_SHELL_UNSET")
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"~", "/home/alice"},
+		{"~/shot.ppm", "/home/alice/shot.ppm"},
+		{"$HOME/shot.ppm", "/home/alice/shot.ppm"},
+		{"${IMAGES}/vm.qcow2", "/var/lib/images/vm.qcow2"},
+		{"/tmp/$QMP_SHELL_UNSET/x", "/tmp/$QMP_SHELL_UNSET/x"},
+		{"~qmp-shell-no-such-user/x", "~qmp-shell-no-such-user/x"},
+		{"/tmp/a~b", "/tmp/a~b"},
+	}
+
+	for _, tt := range tests {
+		if got := expandPath(tt.path); got != tt.want {
+			t.Errorf("expandPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBuildQMPCommandNull(t *testing.T) {
+	for _, value := range []string{"null", "NULL", "Null"} {
+		cmd, err := new(QMPShell).buildQMPCommand("block-set-write-threshold node-name=disk0 write-threshold=" + value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", value, err)
+			continue
+		}
+
+		b, err := json.Marshal(cmd.Arguments)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := `{"node-name":"disk0","write-threshold":null}`; string(b) != want {
+			t.Errorf("%s: arguments = %s, want %s", value, b, want)
+		}
+	}
+}
+
+func TestBuildQMPCommandQuotedNull(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`"null"`, `{"node-name":"null"}`},
+		{`'null'`, `{"node-name":"null"}`},
+		{`'NULL'`, `{"node-name":"NULL"}`},
+	}
+
+	for _, tt := range tests {
+		cmd, err := new(QMPShell).buildQMPCommand("block-set-write-threshold node-name=" + tt.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.value, err)
+			continue
+		}
+
+		b, err := json.Marshal(cmd.Arguments)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != tt.want {
+			t.Errorf("%s: arguments = %s, want %s", tt.value, b, tt.want)
+		}
+	}
+}
+
+func TestParseTimeoutOverride(t *testing.T) {
+	tests := []struct {
+		cmdline  string
+		want     string
+		timeout  time.Duration
+		override bool
+	}{
+		{"query-status", "query-status", 0, false},
+		{"timeout 30m dump-guest-memory paging=false protocol=file:/tmp/x", "dump-guest-memory paging=false protocol=file:/tmp/x", 30 * time.Minute, true},
+		{"dump-guest-memory @timeout=1h30m paging=false", "dump-guest-memory paging=false", 90 * time.Minute, true},
+		{"query-block @timeout=500ms", "query-block", 500 * time.Millisecond, true},
+		{"timeout off hmp info mtree", "hmp info mtree", 0, true},
+		{"human-monitor-command command-line='x@timeout=1s'", "human-monitor-command command-line='x@timeout=1s'", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, timeout, override, err := parseTimeoutOverride(tt.cmdline)
+		if err != nil {
+			t.Errorf("parseTimeoutOverride(%q) error: %s", tt.cmdline, err)
+			continue
+		}
+		if got != tt.want || timeout != tt.timeout || override != tt.override {
+			t.Errorf("parseTimeoutOverride(%q) = %q, %s, %v, want %q, %s, %v", tt.cmdline, got, timeout, override, tt.want, tt.timeout, tt.override)
+		}
+	}
+
+	for _, cmdline := range []string{"timeout 5s", "timeout x query-status", "query-status @timeout=-1s", "query-status @timeout="} {
+		if _, _, _, err := parseTimeoutOverride(cmdline); err == nil {
+			t.Errorf("parseTimeoutOverride(%q): expected an error", cmdline)
+		}
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		code    string
+		comment string
+	}{
+		{"query-status", "query-status", ""},
+		{"query-status   # should be running", "query-status", "# should be running"},
+		{"# a full-line comment", "", "# a full-line comment"},
+		{"  #indented", "", "#indented"},
+		{"set_link name=net#0 up=false", "set_link name=net#0 up=false", ""},
+		{`human-monitor-command command-line="info # x" # hmp`, `human-monitor-command command-line="info # x"`, "# hmp"},
+		{"qom-set path=/x property=y value='a # b'", "qom-set path=/x property=y value='a # b'", ""},
+		{`object-add qom-type=x id=y props={"a": [1, # 2]}`, `object-add qom-type=x id=y props={"a": [1, # 2]}`, ""},
+		{"stop; cont\t# resume", "stop; cont", "# resume"},
+	}
+
+	for _, tt := range tests {
+		code, comment := stripComment(tt.cmdline)
+		if code != tt.code || comment != tt.comment {
+			t.Errorf("stripComment(%q) = %q, %q, want %q, %q", tt.cmdline, code, comment, tt.code, tt.comment)
+		}
+	}
+}
+
+func TestQuoteEscapes(t *testing.T) {
+	// All the scanners of the command line must agree on the strings
+	line := `qom-set path=/x property=y value='it\'s; # {' # comment`
+
+	if err := checkBalance(line); err != nil {
+		t.Errorf("checkBalance(%q): %s", line, err)
+	}
+	if cmds, _, _ := splitChain(line); len(cmds) != 1 {
+		t.Errorf("splitChain(%q) = %q, want one command", line, cmds)
+	}
+	if _, comment := stripComment(line); comment != "# comment" {
+		t.Errorf("stripComment(%q) returned comment %q, want %q", line, comment, "# comment")
+	}
+	if depth := jsonDepth(line); depth != 0 {
+		t.Errorf("jsonDepth(%q) = %d, want 0", line, depth)
+	}
+
+	if args := new(QMPShell).splitString(line, ' '); len(args) != 6 {
+		t.Errorf("splitString(%q) = %q, want 6 fields", line, args)
+	}
+
+	// The quote is escaped, so the string is not terminated
+	line = `qom-set path=/x property=y value='a\'`
+
+	if err := checkBalance(line); err == nil {
+		t.Errorf("checkBalance(%q): no error", line)
+	}
+	if cmds, _, _ := splitChain(line + "; stop"); len(cmds) != 1 {
+		t.Errorf("splitChain(%q) = %q, want one command", line+"; stop", cmds)
+	}
+}
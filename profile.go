@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// profileHeader is the header of the CSV file with the command timings.
+var profileHeader = []string{"command", "args", "start_unix_ms", "elapsed_ms", "error"}
+
+// openProfile creates the CSV file where the timings
+// of the commands sent to QEMU are written.
+func (s *QMPShell) openProfile(fname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("cannot create the profile file: %s", err)
+	}
+
+	s.profileFile = f
+	s.profile = csv.NewWriter(f)
+
+	s.profile.Write(profileHeader)
+	s.profile.Flush()
+
+	return s.profile.Error()
+}
+
+// profileCommand writes the timing of the command to the profile file.
+// The record is flushed immediately, so that the data is not lost
+// if the shell is terminated.
+func (s *QMPShell) profileCommand(cmd *QMPCommand, start time.Time, err error) {
+	if s.profile == nil {
+		return
+	}
+
+	var nargs int
+	if args, ok := cmd.Arguments.(map[string]interface{}); ok {
+		nargs = len(args)
+	}
+
+	var errmsg string
+	if err != nil {
+		errmsg = err.Error()
+	}
+
+	// Commands replayed in parallel are profiled concurrently
+	s.profileMu.Lock()
+	defer s.profileMu.Unlock()
+
+	s.profile.Write([]string{
+		cmd.Name,
+		strconv.Itoa(nargs),
+		strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10),
+		strconv.FormatFloat(float64(time.Since(start))/float64(time.Millisecond), 'f', 3, 64),
+		errmsg,
+	})
+	s.profile.Flush()
+
+	if err := s.profile.Error(); err != nil {
+		Error.Println("cannot write the profile:", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultPrompt is the prompt template used if no other is given.
+const defaultPrompt = "%m_shell/%n> "
+
+// defaultPromptNoName is used instead of defaultPrompt
+// if the monitor does not report the VM name.
+const defaultPromptNoName = "%m_shell> "
+
+// defaultBanner is the first line printed on start of the interactive shell.
+const defaultBanner = "Welcome to the %M low-level shell"
+
+// renderPrompt returns the prompt built from the template
+// (see expandTemplate). In the transaction mode (see startTxn)
+// the prompt is always "txn> ".
+func (s *QMPShell) renderPrompt() string {
+	if s.txn != nil {
+		return "txn> "
+	}
+
+	return s.expandTemplate(s.prompt)
+}
+
+// expandTemplate returns the prompt or banner template with
+// the placeholders replaced. The following placeholders are supported:
+//
+//	%n, {name}     -- VM name
+//	%m, {mode}     -- shell mode: qmp or hmp
+//	%M             -- shell mode in upper case: QMP or HMP
+//	%v, {version}  -- QEMU version
+//	%s, {status}   -- VM run state (e.g. running, paused)
+//	%t, {time}     -- current time (HH:MM:SS)
+//	{socket}       -- monitor socket path
+//	%%             -- percent sign
+//
+// Unknown placeholders are left as is.
+func (s *QMPShell) expandTemplate(tmpl string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(tmpl); i++ {
+		switch {
+		case tmpl[i] == '%' && i+1 < len(tmpl):
+			if v, ok := s.placeholder(tmpl[i+1 : i+2]); ok {
+				b.WriteString(v)
+			} else if tmpl[i+1] == '%' {
+				b.WriteByte('%')
+			} else {
+				b.WriteString(tmpl[i : i+2])
+			}
+			i++
+		case tmpl[i] == '{':
+			end := strings.IndexByte(tmpl[i:], '}')
+			if end == -1 {
+				b.WriteByte(tmpl[i])
+				continue
+			}
+			// Only the long names are allowed in braces
+			if v, ok := s.placeholder(tmpl[i+1 : i+end]); ok && end > 2 {
+				b.WriteString(v)
+				i += end
+				continue
+			}
+			b.WriteByte(tmpl[i])
+		default:
+			b.WriteByte(tmpl[i])
+		}
+	}
+
+	return b.String()
+}
+
+// placeholder returns the value of the template placeholder
+// given by its short (one-letter) or long name.
+func (s *QMPShell) placeholder(name string) (string, bool) {
+	mode := "qmp"
+	if s.isHMP {
+		mode = "hmp"
+	}
+
+	switch name {
+	case "n", "name":
+		return s.vmname, true
+	case "m", "mode":
+		return mode, true
+	case "M":
+		return strings.ToUpper(mode), true
+	case "v", "version":
+		return s.qemuVer, true
+	case "s", "status":
+		return s.runState(), true
+	case "t", "time":
+		return time.Now().Format("15:04:05"), true
+	case "socket":
+		return s.socket, true
+	}
+
+	return "", false
+}
+
+// runState returns the current run state of the VM
+// or "?" if it cannot be obtained quickly.
+func (s *QMPShell) runState() string {
+	// The monitor is busy until the abandoned command completes
+	if atomic.LoadInt32(&s.abandoned) > 0 {
+		return "?"
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 2*time.Second)
+	defer cancel()
+
+	status := struct {
+		Status string `json:"status"`
+	}{}
+
+	if err := s.run(ctx, QMPCommand{"query-status", nil}, &status); err != nil {
+		return "?"
+	}
+
+	return status.Status
+}
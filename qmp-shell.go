@@ -2,16 +2,24 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unicode"
@@ -22,38 +30,414 @@ import (
 )
 
 var (
-	Error = log.New(os.Stdout, "qmp_shell error: ", 0)
+	Error   = log.New(os.Stderr, "qmp_shell error: ", 0)
+	Warning = log.New(os.Stderr, "qmp_shell warning: ", 0)
+	Info    = log.New(ioutil.Discard, "qmp_shell info: ", 0)
+	Debug   = log.New(ioutil.Discard, "qmp_shell debug: ", 0)
 
 	ErrBadCommandFormat = errors.New("command format: <command-name>  [arg-name1=arg1] ... [arg-nameN=argN]")
+
+	ErrCommandInterrupted = errors.New("command abandoned (still running on the VM)")
+	ErrCommandTimeout     = errors.New("command timed out")
+	ErrConnectionClosed   = errors.New("connection closed by QEMU")
+	ErrOOBNotAvailable    = errors.New("out-of-band execution is not available: the connection is negotiated without the oob capability")
+)
+
+// Exit codes of the non-interactive modes.
+const (
+	ExitOK         = 0
+	ExitFailure    = 1 // any other error
+	ExitUsage      = 2
+	ExitConnection = 3 // cannot connect or the connection was lost
+	ExitCommand    = 4 // the command failed
 )
 
 type QMPCommand qmp.Command
 
+// Ctrl-C behaviors at the prompt of the interactive shell, see Options.CtrlC.
+const (
+	ctrlcAbort = "abort"
+	ctrlcClear = "clear"
+)
+
+// minTestedVersion is the oldest QEMU version the shell is tested with.
+// It is the first version with query-qmp-schema.
+var minTestedVersion = [3]int{2, 5, 0}
+
+// Options contains the settings that are used
+// when creating a new shell.
+type Options struct {
+	// Path to a file with the pre-downloaded output of query-qmp-schema.
+	// If set, the schema is not requested from QEMU.
+	SchemaFile string
+
+	// If true, commands are validated against the schema
+	// before sending.
+	Strict bool
+
+	// If true, arguments are not validated against the schema.
+	NoValidate bool
+
+	// If true, no warnings are printed when running
+	// commands that are marked as deprecated in the schema.
+	NoDeprecationWarnings bool
+
+	// The default timeout of a command. Zero means no timeout.
+	CommandTimeout time.Duration
+
+	// Path to a file with commands that are executed
+	// before the first prompt of the interactive shell.
+	InitFile string
+
+	// If not zero, query-status is periodically run with this interval
+	// to detect a dead connection.
+	Keepalive time.Duration
+
+	// Comma-separated list of result fields with base64 blobs
+	// to be decoded, see decodeBase64Fields for details.
+	DecodeBase64 string
+
+	// Strings of the results longer than this (in bytes) are truncated
+	// for display. Zero means no limit.
+	MaxField int
+
+	// Name of the color scheme used to highlight JSON results
+	// (see colorSchemes). Empty means no colors.
+	ColorScheme string
+
+	// Path to a file where the commands of the session are recorded.
+	RecordFile string
+
+	// Path to a CSV file where the timings
+	// of the commands of the session are written.
+	ProfileFile string
+
+	// If true, large integers of the results are annotated
+	// with human-readable sizes.
+	Humanize bool
+
+	// If true, the results are printed exactly as they are received
+	// from the monitor, without any formatting.
+	Raw bool
+
+	// If true, each command outputs a single-line JSON record
+	// with the command, its result and error (see jsonRecord).
+	JSON bool
+
+	// The same as JSON, but the record also contains the command
+	// sent to QEMU and the timing (see envelopeRecord).
+	Envelope bool
+
+	// If true, the dangerous commands (see defaultDangerous)
+	// are executed without a confirmation.
+	Yes bool
+
+	// If true, the dangerous commands are refused
+	// in the non-interactive modes.
+	Safe bool
+
+	// Number of retries of a command that failed with an I/O error
+	// and the delay between them.
+	RetryCount int
+	RetryDelay time.Duration
+
+	// Completion engine: names-only (default), schema or none.
+	CompletionEngine string
+
+	// If not empty, only the commands starting with this prefix
+	// are offered for completion.
+	CommandPrefix string
+
+	// What Ctrl-C does at the prompt: "abort" (default) ends
+	// the shell, "clear" discards the input and shows a new prompt.
+	// A running command is interrupted in both cases.
+	CtrlC string
+
+	// Prompt and banner templates, see expandTemplate for details.
+	// If empty, defaultPrompt and defaultBanner are used.
+	Prompt string
+	Banner string
+
+	// If true, the first line of the banner is not printed.
+	NoBanner bool
+
+	// If true, the received events are not printed
+	// when Enter is pressed at an empty prompt.
+	QuietEvents bool
+
+	// How long to wait for the QMP greeting when connecting.
+	// Zero disables the check, and the greeting is not available.
+	ProbeTimeout time.Duration
+
+	// If true, the QMP greeting is printed on start
+	// of the interactive shell.
+	ShowGreeting bool
+
+	// Maximum size of the history file in bytes.
+	// The oldest entries are dropped to fit. Zero means no limit.
+	MaxHistoryBytes int64
+
+	// If not empty, the shell refuses to connect to a VM
+	// whose name does not match this glob pattern.
+	VMNameFilter string
+
+	// If true, JSON values of the arguments may have unquoted keys,
+	// single-quoted strings and trailing commas.
+	RelaxedJSON bool
+
+	// If not empty ("[user@]host"), the socket path is on the remote
+	// host and is reached through an SSH tunnel. SSHKey is the private
+	// key used instead of the agent and the default keys.
+	SSHDest string
+	SSHKey  string
+}
+
 type QMPShell struct {
 	monitor *qmp.Monitor
 	line    *liner.State
 	vmname  string
+	socket  string
 	prompt  string
-	banner  string
+	banner  string // empty if suppressed
 	qemuVer string
-	isHMP   bool
+
+	completion string
+
+	// If true, completionShortcuts are offered for completion
+	shortcuts bool
+
+	// Only the commands with this prefix are completed
+	commandPrefix string
+
+	// Argument values used in the session, for the completion
+	argValues map[string][]string
+
+	// The QMP greeting or nil if it could not be read
+	greeting     json.RawMessage
+	showGreeting bool
+	isHMP        bool
+
+	commands []string
+	schema   *Schema
+
+	// The file the schema is imported from, if any
+	schemaFile string
+
+	// HMP command list and the cached device names for the completion.
+	// The command list is built in background, see loadHMPCommands
+	hmpMu        sync.Mutex
+	hmpCommands  []string
+	hmpNames     []string
+	hmpNamesTime time.Time
+
+	histEnabled  bool
+	histSize     int
+	histMaxBytes int64
+	histDedup    bool
+	histIgnore   []string
+
+	// Timestamps and exit codes of the history items
+	// for the JSON Lines history files
+	histMeta map[string]historyEntry
+
+	strict      bool
+	validate    bool
+	relaxedJSON bool
+
+	// If true, commands without required arguments
+	// are not sent to QEMU
+	requireArgs bool
+
+	deprecationWarnings bool
+	deprecationWarned   map[string]struct{}
+
+	cmdTimeout time.Duration
+
+	initFile string
+
+	decodeBase64 []string
+
+	// Strings of the results longer than this are truncated
+	// for display. Zero means no limit.
+	maxField int
+
+	colors ColorScheme
+
+	humanize bool
+	format   string // output format of the results, see formatResult
+	jsonOut  bool
+	envelope bool
+
+	// If true, nothing is shown for empty results instead of okResult
+	quiet bool
+
+	// Commands that require a confirmation in the interactive mode
+	// or are refused in the other modes if safe is true
+	dangerous        []string
+	confirmDangerous bool
+	safe             bool
+
+	// What Ctrl-C does at the prompt (ctrlcAbort or ctrlcClear)
+	ctrlc string
+
+	// True while the interactive shell is running
+	interactive bool
+
+	retryCount int
+	retryDelay time.Duration
+
+	record *os.File
+
+	// SSH tunnel to the remote socket or nil
+	tunnel *sshTunnel
+
+	// CSV file with the timings of the commands
+	profile     *csv.Writer
+	profileFile *os.File
+	profileMu   sync.Mutex
+
+	aliases map[string]string
+
+	histfile string
+	histMu   sync.Mutex
+
+	notices   []string
+	noticesMu sync.Mutex
+
+	// Events received from the monitor (see pumpEvents)
+	// and the cursor of the events shown at the prompt
+	events   *eventRing
+	eventSeq uint64
+	pumpDone chan struct{} // closed when pumpEvents returns
+
+	// If true, showEvents does not print the events
+	quietEvents bool
+
+	// Events before this cursor are ignored by the wait-event command
+	waitSeq uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Actions of the transaction being built by the txn command.
+	// If nil, the shell is not in the transaction mode
+	txn []txnAction
+
+	// Number of abandoned commands whose replies are not received yet
+	abandoned int32
+
+	// The raw result of the last QMP command
+	lastResult json.RawMessage
+
+	// The last command sent to QEMU (nil if the last command line
+	// was not sent) and the time when its execution started
+	lastCommand *QMPCommand
+	lastStart   time.Time
 }
 
-func NewQMPShell(socket string) (*QMPShell, error) {
-	monitor, err := qmp.NewMonitor(socket, 60*time.Second)
+func NewQMPShell(socket string, opts *Options) (*QMPShell, error) {
+	var colors ColorScheme
+
+	if len(opts.ColorScheme) > 0 {
+		var ok bool
+		if colors, ok = colorSchemes[opts.ColorScheme]; !ok {
+			return nil, fmt.Errorf("unknown color scheme: %s (available: %s)", opts.ColorScheme, strings.Join(colorSchemeNames(), ", "))
+		}
+	}
+
+	switch opts.CompletionEngine {
+	case "", completionNamesOnly, completionSchema, completionNone:
+	default:
+		return nil, fmt.Errorf("unknown completion engine: %s (available: %s)", opts.CompletionEngine, strings.Join(completionEngines, ", "))
+	}
+
+	switch opts.CtrlC {
+	case "", ctrlcAbort, ctrlcClear:
+	default:
+		return nil, fmt.Errorf("unknown Ctrl-C behavior: %s (available: %s, %s)", opts.CtrlC, ctrlcAbort, ctrlcClear)
+	}
+
+	// The remote socket is dialed through the local end of the tunnel
+	dialSocket := socket
+
+	var tunnel *sshTunnel
+	var monitor *qmp.Monitor
+
+	// Until the shell is built, the tunnel and the monitor
+	// are closed on errors. Then it is done by shell.Close
+	var built bool
+
+	defer func() {
+		if built {
+			return
+		}
+		if monitor != nil {
+			monitor.Close()
+		}
+		if tunnel != nil {
+			tunnel.Close()
+		}
+	}()
+
+	if len(opts.SSHDest) > 0 {
+		var err error
+		if tunnel, err = openSSHTunnel(opts.SSHDest, opts.SSHKey, socket, 30*time.Second); err != nil {
+			return nil, err
+		}
+		Info.Printf("SSH tunnel to %s:%s is opened at %s", opts.SSHDest, socket, tunnel.socket)
+		dialSocket = tunnel.socket
+		socket = opts.SSHDest + ":" + socket
+	}
+
+	// Only one client can be connected to the monitor at a time,
+	// so the greeting is read before the main connection.
+	// It also detects sockets that are not QMP monitors,
+	// which would otherwise hang until the connection timeout.
+	var greeting json.RawMessage
+
+	if opts.ProbeTimeout > 0 {
+		var err error
+		// Other errors are reported when connecting the monitor
+		greeting, err = readGreeting(dialSocket, opts.ProbeTimeout)
+		if _, ok := err.(*notQMPError); ok {
+			return nil, fmt.Errorf("%s: %s", socket, err)
+		}
+	}
+
+	monitor, err := qmp.NewMonitor(dialSocket, 60*time.Second)
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect to the socket: %s", socket)
 	}
 
+	// The commands sent before the shell is built
+	run := func(cmd, res interface{}) error {
+		start := time.Now()
+		err := monitor.Run(cmd, res)
+		debugCommand(cmd, start, err)
+		return err
+	}
+
 	// Getting the virtual machine name
 	vm := struct {
 		Name string `json:"name"`
 	}{}
 
-	if err := monitor.Run(QMPCommand{"query-name", nil}, &vm); err != nil {
+	// Some monitors (e.g. qemu-storage-daemon) have no query-name,
+	// the name is empty then
+	if err := run(QMPCommand{"query-name", nil}, &vm); err != nil && !isCommandNotFound(err) {
 		return nil, err
 	}
 
+	if len(opts.VMNameFilter) > 0 {
+		matched, err := filepath.Match(opts.VMNameFilter, vm.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VM name filter %q: %s", opts.VMNameFilter, err)
+		}
+		if !matched {
+			return nil, fmt.Errorf("VM name %q does not match the filter %q", vm.Name, opts.VMNameFilter)
+		}
+	}
+
 	// Getting the QEMU version
 	version := struct {
 		Qemu struct {
@@ -63,160 +447,749 @@ func NewQMPShell(socket string) (*QMPShell, error) {
 		} `json:"qemu"`
 	}{}
 
-	if err := monitor.Run(QMPCommand{"query-version", nil}, &version); err != nil {
+	if err := run(QMPCommand{"query-version", nil}, &version); err != nil && !isCommandNotFound(err) {
 		return nil, err
 	}
 
-	// Building the QMP command list
-	qmpCommands := []struct {
-		Name string `json:"name"`
-	}{}
+	qemuVer := [3]int{version.Qemu.Major, version.Qemu.Minor, version.Qemu.Micro}
 
-	if err := monitor.Run(QMPCommand{"query-commands", nil}, &qmpCommands); err != nil {
-		return nil, fmt.Errorf("cannot build the QMP command list: %s", err)
+	// The version is unknown if the command or its fields are missing
+	qemuVerStr := "unknown"
+	if qemuVer != [3]int{} {
+		qemuVerStr = fmt.Sprintf("%d.%d.%d", qemuVer[0], qemuVer[1], qemuVer[2])
 	}
 
-	var cmdlist []string
+	Info.Printf("connected to %s (VM %q, QEMU %s)", socket, vm.Name, qemuVerStr)
 
-	for _, cmd := range qmpCommands {
-		cmdlist = append(cmdlist, cmd.Name)
+	if qemuVer != [3]int{} && versionLess(qemuVer, minTestedVersion) {
+		msg := fmt.Sprintf("QEMU %d.%d.%d is older than %d.%d.%d, the oldest version qmp-shell is tested with", qemuVer[0], qemuVer[1], qemuVer[2], minTestedVersion[0], minTestedVersion[1], minTestedVersion[2])
+		if len(opts.SchemaFile) == 0 {
+			msg += ": it may not support query-qmp-schema, so the validation, strict mode and schema completion may be disabled"
+		}
+		Warning.Println(msg)
 	}
 
-	sort.Strings(cmdlist)
+	cmdlist, err := queryCommandList(run)
+	if err != nil {
+		return nil, err
+	}
 
-	// Configuring the linear
-	line := liner.NewLiner()
-	line.SetCtrlCAborts(true)
+	var schema *Schema
 
-	line.SetCompleter(func(line string) (c []string) {
-		for _, n := range cmdlist {
-			if strings.HasPrefix(n, strings.ToLower(line)) {
-				c = append(c, n)
-			}
+	if len(opts.SchemaFile) > 0 {
+		if schema, err = LoadSchema(opts.SchemaFile); err != nil {
+			return nil, err
 		}
-		return
-	})
+	} else {
+		schema = querySchema(run)
+	}
 
+	// Configuring the linear
+	line := liner.NewLiner()
+	line.SetCtrlCAborts(true)
 	line.SetTabCompletionStyle(liner.TabPrints)
 
 	// Building the shell
 	shell := QMPShell{
-		monitor: monitor,
-		line:    line,
-		vmname:  vm.Name,
-		prompt:  fmt.Sprintf("qmp_shell/%s> ", vm.Name),
-		banner:  "Welcome to the QMP low-level shell",
-		qemuVer: fmt.Sprintf("%d.%d.%d", version.Qemu.Major, version.Qemu.Minor, version.Qemu.Micro),
+		monitor:    monitor,
+		line:       line,
+		vmname:     vm.Name,
+		socket:     socket,
+		tunnel:     tunnel,
+		prompt:     opts.Prompt,
+		completion: opts.CompletionEngine,
+		banner:     opts.Banner,
+		greeting:   greeting,
+		qemuVer:    qemuVerStr,
+		commands:   cmdlist,
+		schema:     schema,
+		schemaFile: opts.SchemaFile,
+		strict:     opts.Strict,
+		validate:   !opts.NoValidate,
+
+		requireArgs:   true,
+		commandPrefix: opts.CommandPrefix,
+
+		cmdTimeout: opts.CommandTimeout,
+		initFile:   opts.InitFile,
+
+		decodeBase64: parseList(opts.DecodeBase64),
+		maxField:     opts.MaxField,
+		colors:       colors,
+		humanize:     opts.Humanize,
+		format:       outputJSON,
+		jsonOut:      opts.JSON || opts.Envelope,
+		envelope:     opts.Envelope,
+
+		dangerous:        defaultDangerous,
+		confirmDangerous: !opts.Yes,
+		safe:             opts.Safe,
+		relaxedJSON:      opts.RelaxedJSON,
+		ctrlc:            opts.CtrlC,
+
+		showGreeting: opts.ShowGreeting,
+		retryCount:   opts.RetryCount,
+		retryDelay:   opts.RetryDelay,
+
+		histEnabled:  true,
+		histSize:     liner.HistoryLimit,
+		histMaxBytes: opts.MaxHistoryBytes,
+		histIgnore:   defaultHistIgnore,
+		histMeta:     make(map[string]historyEntry),
+
+		deprecationWarnings: !opts.NoDeprecationWarnings,
+		deprecationWarned:   make(map[string]struct{}),
+
+		events: newEventRing(eventRingSize, monitor.FindEvents),
+
+		quietEvents: opts.QuietEvents,
+	}
+
+	if fname, ok := aliasFile(); ok {
+		if shell.aliases, err = loadAliases(fname); err != nil {
+			Warning.Printf("cannot load aliases: %s", err)
+		}
+	}
+	if shell.aliases == nil {
+		shell.aliases = make(map[string]string)
+	}
+
+	if fname, ok := dangerousFile(); ok {
+		if names, err := loadDangerous(fname); err != nil {
+			Warning.Printf("cannot load the list of dangerous commands: %s", err)
+		} else if names != nil {
+			shell.dangerous = names
+		}
+	}
+
+	if len(shell.prompt) == 0 {
+		shell.prompt = defaultPrompt
+		if len(shell.vmname) == 0 {
+			shell.prompt = defaultPromptNoName
+		}
+	}
+	if len(shell.banner) == 0 && !opts.NoBanner {
+		shell.banner = defaultBanner
+	}
+	if len(shell.completion) == 0 {
+		shell.completion = completionNamesOnly
+	}
+	if opts.Raw {
+		shell.format = outputRaw
+	}
+
+	if shell.strict && shell.schema == nil {
+		Warning.Println("QMP schema is not available, strict mode is disabled")
+		shell.strict = false
+	}
+	if shell.completion == completionSchema && shell.schema == nil {
+		Warning.Println("QMP schema is not available, only command names are completed")
+		shell.completion = completionNamesOnly
+	}
+
+	shell.ctx, shell.cancel = context.WithCancel(context.Background())
+
+	built = true
+
+	shell.pumpDone = make(chan struct{})
+
+	go func() {
+		shell.pumpEvents(100 * time.Millisecond)
+		close(shell.pumpDone)
+	}()
+
+	if len(opts.RecordFile) > 0 {
+		if err := shell.openRecord(opts.RecordFile); err != nil {
+			shell.Close()
+			return nil, err
+		}
+	}
+
+	if len(opts.ProfileFile) > 0 {
+		if err := shell.openProfile(opts.ProfileFile); err != nil {
+			shell.Close()
+			return nil, err
+		}
+	}
+
+	if shell.completion != completionNone {
+		line.SetWordCompleter(shell.complete)
+	}
+
+	if opts.Keepalive > 0 {
+		go shell.keepalive(opts.Keepalive)
 	}
 
 	return &shell, nil
 }
 
 func (s *QMPShell) Close() {
-	defer s.monitor.Close()
-	defer s.line.Close()
-}
+	s.cancel()
+
+	// The monitor must not be used after it is closed
+	<-s.pumpDone
+
+	Info.Printf("disconnected from %s", s.socket)
+
+	if s.record != nil {
+		s.record.Close()
+	}
 
-func (s *QMPShell) LoadHistory(histfile string) error {
-	f, err := os.Open(histfile)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("reading history file: %s", err)
+	if s.profileFile != nil {
+		s.profileFile.Close()
 	}
-	defer f.Close()
 
-	s.line.ReadHistory(f)
+	defer s.line.Close()
 
-	return nil
-}
+	if s.tunnel != nil {
+		defer s.tunnel.Close()
+	}
 
-func (s *QMPShell) SaveHistory(histfile string) error {
-	f, err := os.Create(histfile)
-	if err != nil {
-		return fmt.Errorf("writing history file: %s", err)
+	// The monitor cannot be closed until the reply to an abandoned
+	// command is received. There is no need to wait for it on exit
+	if atomic.LoadInt32(&s.abandoned) > 0 {
+		go s.monitor.Close()
+		return
 	}
-	defer f.Close()
 
-	s.line.WriteHistory(f)
+	defer s.monitor.Close()
+}
 
-	return nil
+func (s *QMPShell) VMName() string {
+	return s.vmname
 }
 
+// Serve runs the interactive shell until the input is closed
+// or the user exits.
 func (s *QMPShell) Serve() error {
-	fmt.Println(s.banner)
+	return s.ServeContext(context.Background())
+}
+
+// ServeContext is like Serve, but also returns ctx.Err()
+// when the context is done. The context is checked before
+// each prompt, and the running command is interrupted.
+func (s *QMPShell) ServeContext(ctx context.Context) error {
+	s.interactive = isatty(os.Stdin)
+	defer func() { s.interactive = false }()
+
+	if len(s.banner) > 0 {
+		fmt.Println(s.expandTemplate(s.banner))
+	}
 	fmt.Println("Connected to QEMU", s.qemuVer)
 	fmt.Println()
 
-	var ts uint64
+	if s.showGreeting {
+		if res, err := s.showGreetingCmd(s.ctx, []string{".greeting"}); err == nil {
+			fmt.Println(res)
+			fmt.Println()
+		} else {
+			Error.Println(err)
+		}
+	}
+
+	// Errors in the init script do not prevent
+	// the interactive session from starting
+	if len(s.initFile) > 0 {
+		ctx, cancel := interruptContext(ctx)
+		if failed, err := s.runScript(ctx, s.initFile); err != nil {
+			Error.Println("init script:", err)
+		} else if failed > 0 {
+			Error.Printf("init script: %d command(s) failed\n", failed)
+		}
+		cancel()
+	}
+
+	var suggestion string
 
 	for {
-		cmdline, err := s.line.Prompt(s.prompt)
+		select {
+		case <-ctx.Done():
+			s.line.Close()
+			return ctx.Err()
+		default:
+		}
+
+		s.flushNotices()
+
+		cmdline, err := s.line.PromptWithSuggestion(s.renderPrompt(), suggestion, -1)
+		suggestion = ""
 		switch err {
 		case nil:
 			if len(cmdline) == 0 {
-				if events, found := s.monitor.FindEvents("", ts); found {
-					for _, e := range events {
-						fmt.Printf(
-							"Received QMP Event %s: %v, Timestamp: seconds = %d, microseconds = %d\n",
-							e.Type,
-							e.Data,
-							e.Timestamp.Seconds,
-							e.Timestamp.Microseconds,
-						)
-						ts = e.Timestamp.Seconds + 1
+				s.showEvents()
+				continue
+			}
+			// The command is not executed until all JSON objects
+			// and arrays are closed, so a pasted multi-line value
+			// is taken as a single command
+			if code, _ := stripComment(cmdline); jsonDepth(code) > 0 {
+				if cmdline, err = s.readContinuation(cmdline); err != nil {
+					if err == liner.ErrPromptAborted {
+						continue
 					}
+					fmt.Println()
+					return nil
 				}
+			}
+			// A trailing "?" shows the command synopsis
+			// and then the line is edited again
+			if trimmed := strings.TrimRightFunc(cmdline, unicode.IsSpace); strings.HasSuffix(trimmed, " ?") {
+				suggestion = strings.TrimSuffix(trimmed, "?")
+				fmt.Println(s.synopsis(strings.Fields(trimmed)[0]))
 				continue
 			}
-			s.line.AppendHistory(cmdline)
-			if res, err := s.executeCommand(cmdline); err == nil {
+			// "/edit [<command>]" composes the command in the editor.
+			// The result is executed and saved in the history
+			// as a regular command line
+			if fields := strings.SplitN(strings.TrimSpace(cmdline), " ", 2); fields[0] == "/edit" {
+				if len(fields) == 1 {
+					fields = append(fields, "")
+				}
+				if cmdline, err = editCommand(strings.TrimSpace(fields[1])); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				if len(cmdline) == 0 {
+					continue
+				}
+				fmt.Println(s.renderPrompt() + cmdline)
+			}
+			// Ctrl-C interrupts the running command,
+			// but not the shell itself
+			ctx, cancel := interruptContext(ctx)
+			res, err := s.executeCommand(ctx, cmdline)
+			cancel()
+			s.recordHistory(cmdline, err)
+			if len(res) > 0 {
 				fmt.Println(res)
-			} else {
+			}
+			switch err {
+			case nil:
+			case ErrConnectionClosed:
+				fmt.Println(err)
+				return nil
+			default:
 				fmt.Println(err)
 			}
 		case liner.ErrPromptAborted:
-			log.Print("Aborted")
+			// The line editor has already printed "^C"
+			if s.ctrlc == ctrlcClear {
+				continue
+			}
+			Info.Println("aborted by Ctrl-C")
 			return nil
 		default:
 			fmt.Println()
 			return nil
 		}
 	}
+}
+
+// synopsis returns the description of the command arguments.
+// In the HMP mode it is the output of "help <command>".
+func (s *QMPShell) synopsis(cmdname string) string {
+	var res string
+	var err error
+
+	switch {
+	case s.isHMP:
+		res, err = s.Execute("help " + cmdname)
+	case s.schema == nil:
+		err = fmt.Errorf("QMP schema is not available")
+	default:
+		res, err = s.schema.Synopsis(cmdname)
+	}
+
+	if err != nil {
+		return err.Error()
+	}
 
-	return nil
+	return strings.TrimRight(res, "\r\n")
 }
 
 func (s *QMPShell) Execute(cmdline string) (string, error) {
-	return s.executeCommand(cmdline)
+	return s.executeCommand(context.Background(), cmdline)
+}
+
+// LastResult returns the raw result of the last executed
+// QMP command or nil if it was not a QMP command or failed.
+func (s *QMPShell) LastResult() json.RawMessage {
+	return s.lastResult
+}
+
+// executeCommand executes the command line that may contain
+// several commands chained with "&&" or ";" (see executeChain).
+// In the JSON output mode the result is a JSON record
+// that also contains the error, if any.
+func (s *QMPShell) executeCommand(ctx context.Context, cmdline string) (string, error) {
+	s.lastResult, s.lastCommand, s.lastStart = nil, nil, time.Now()
+
+	// The trailing comment is not sent to QEMU, but is kept
+	// in the session record (and in the history by the caller)
+	code, comment := stripComment(cmdline)
+	if len(comment) > 0 {
+		s.recordCommand(comment)
+	}
+	if len(code) == 0 {
+		return "", nil
+	}
+
+	cmds, ops, err := splitChain(code)
+	if err != nil {
+		return s.jsonResult(cmdline, "", err)
+	}
+
+	if len(cmds) == 1 {
+		res, err := s.executeOne(ctx, cmds[0])
+		return s.jsonResult(cmdline, res, err)
+	}
+
+	return s.executeChain(ctx, cmds, ops)
 }
 
-func (s *QMPShell) executeCommand(cmdline string) (string, error) {
-	if s.isHMP {
-		cmdline = fmt.Sprintf("human-monitor-command command-line='%s'", cmdline)
+// jsonResult wraps the result and the error into a JSON record
+// if the JSON output mode is enabled.
+func (s *QMPShell) jsonResult(cmdline, res string, err error) (string, error) {
+	if s.jsonOut {
+		return s.formatJSONRecord(cmdline, res, err), err
 	}
+	return res, err
+}
+
+// executeOne executes a single command.
+func (s *QMPShell) executeOne(ctx context.Context, cmdline string) (string, error) {
+	s.lastCommand, s.lastStart = nil, time.Now()
 
-	cmd, err := s.buildQMPCommand(cmdline)
+	cmdline = s.expandAlias(cmdline)
+
+	// The record keeps the timeout override, so it is replayed as well
+	record := cmdline
+
+	cmdline, timeout, override, err := parseTimeoutOverride(cmdline)
 	if err != nil {
 		return "", err
 	}
+	if !override {
+		timeout = s.cmdTimeout
+	}
+
+	if s.txn != nil {
+		if res, ok, err := s.txnCommand(ctx, cmdline); ok {
+			if override {
+				return "", fmt.Errorf("the timeout cannot be overridden in the transaction mode")
+			}
+			return res, err
+		}
+	}
+
+	if override {
+		if _, ok := builtinCommands[strings.SplitN(cmdline, " ", 2)[0]]; ok {
+			return "", fmt.Errorf("the timeout cannot be overridden for built-in commands")
+		}
+	}
+
+	if res, ok, err := s.runBuiltin(ctx, cmdline); ok {
+		return res, err
+	}
+
+	cmd, err := s.prepareCommand(cmdline)
+	if err != nil {
+		return "", err
+	}
+
+	s.recordCommand(record)
+
+	s.lastCommand = cmd
+
+	return s.sendCommand(ctx, cmd, timeout)
+}
+
+// prepareCommand builds the QMP command from the command line
+// (wrapping HMP commands into human-monitor-command) and checks it
+// against the schema. Dangerous commands are confirmed here as well.
+func (s *QMPShell) prepareCommand(cmdline string) (*QMPCommand, error) {
+	var cmd *QMPCommand
+
+	if hmpCmdline, ok := s.hmpCommandLine(cmdline); ok {
+		if len(hmpCmdline) == 0 {
+			return nil, fmt.Errorf("usage: hmp <HMP command>")
+		}
+		// The command line is passed as is, so it may contain
+		// any characters including quotes
+		cmd = &QMPCommand{"human-monitor-command", map[string]interface{}{"command-line": hmpCmdline}}
+	} else {
+		var err error
+		if cmd, err = s.buildQMPCommand(cmdline); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.strict {
+		if err := s.schema.checkCommand(cmd); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.requireArgs && s.schema != nil {
+		if err := s.schema.checkRequiredArguments(cmd); err != nil {
+			return nil, err
+		}
+	}
+
+	if (s.validate || s.strict) && s.schema != nil {
+		if err := s.schema.validateArguments(cmd); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.deprecationWarnings && s.schema != nil {
+		s.warnDeprecated(cmd)
+	}
+
+	if err := s.checkDangerous(cmd); err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+// sendCommand sends the command to QEMU and returns
+// the formatted result.
+func (s *QMPShell) sendCommand(ctx context.Context, cmd *QMPCommand, timeout time.Duration) (string, error) {
+	raw, err := s.send(ctx, cmd, timeout)
+	if err != nil {
+		return "", err
+	}
+
+	s.lastResult = raw
+
+	return s.formatReturn(cmd.Name, raw)
+}
+
+// send sends the command to QEMU and returns the raw result.
+// Unlike sendCommand it does not change the shell state,
+// so it can be called concurrently.
+func (s *QMPShell) send(ctx context.Context, cmd *QMPCommand, timeout time.Duration) (json.RawMessage, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var raw json.RawMessage
+
+	start := time.Now()
+	err := s.runWithRetry(ctx, cmd, &raw)
+	s.profileCommand(cmd, start, err)
+
+	switch {
+	case err == ErrCommandTimeout:
+		return nil, fmt.Errorf("%s: timed out after %s (QEMU may still be executing it)", cmd.Name, timeout)
+	case err != nil:
+		return nil, err
+	}
+
+	return raw, nil
+}
+
+// okResult is shown instead of empty results of successful commands.
+const okResult = "OK"
+
+// formatReturn formats the raw result of the command for display.
+func (s *QMPShell) formatReturn(cmdname string, raw json.RawMessage) (string, error) {
+	// The raw JSON of the "return" field is kept as is,
+	// so the key order and the integer precision are preserved
+	if (s.format == outputRaw || s.jsonOut) && cmdname != "human-monitor-command" {
+		return string(raw), nil
+	}
 
 	var res interface{}
 
-	if err := s.monitor.Run(cmd, &res); err != nil {
+	if err := decodeJSON(raw, &res); err != nil {
 		return "", err
 	}
 
-	if cmd.Name == "human-monitor-command" {
+	if cmdname == "human-monitor-command" {
 		return fmt.Sprintf("%s", res), nil
 	}
 
-	if strB, err := json.MarshalIndent(res, "", "    "); err == nil {
-		return string(strB), nil
-	} else {
-		return "", nil
+	// Many commands (e.g. stop or cont) return an empty object
+	// or nothing at all, which is not worth showing as JSON
+	if obj, ok := res.(map[string]interface{}); res == nil || ok && len(obj) == 0 {
+		if s.quiet {
+			return "", nil
+		}
+		return okResult, nil
+	}
+
+	return s.formatResult(res)
+}
+
+// formatResult formats the result of a QMP command according
+// to the output format (indented JSON by default) and the display options.
+func (s *QMPShell) formatResult(res interface{}) (string, error) {
+	var dumps string
+	var err error
+
+	if len(s.decodeBase64) > 0 {
+		if dumps, err = decodeBase64Fields(res, s.decodeBase64); err != nil {
+			return "", err
+		}
+	}
+
+	if s.maxField > 0 {
+		res = truncateStrings(res, s.maxField)
+	}
+
+	var out string
+
+	switch s.format {
+	case outputYAML:
+		out = formatYAML(res)
+	case outputCompact:
+		out = colorizeJSON(compactJSON(res), s.colors)
+	case outputTable:
+		if out, err = formatValueTable(res); err != nil {
+			return "", err
+		}
+	default:
+		strB, err := json.MarshalIndent(res, "", "    ")
+		if err != nil {
+			return "", nil
+		}
+		out = string(strB)
+		if s.humanize {
+			out = humanizeSizes(out)
+		}
+		out = colorizeJSON(out, s.colors)
+	}
+
+	if len(dumps) > 0 {
+		return out + "\n" + dumps, nil
+	}
+
+	return out, nil
+}
+
+// run executes the command like monitor.Run, but returns
+// ErrCommandInterrupted (or ErrCommandTimeout if the context
+// deadline is exceeded) as soon as the context is done.
+// If the connection is lost, ErrConnectionClosed is returned.
+//
+// The monitor does not support cancellation, so the command
+// keeps running on the QEMU side and its reply is discarded.
+// The monitor does not accept a new command until the reply
+// to the previous one is received, so the late reply can not
+// be taken as a reply to another command.
+func (s *QMPShell) run(ctx context.Context, cmd interface{}, res interface{}) error {
+	errc := make(chan error, 1)
+
+	var done int32
+
+	if atomic.LoadInt32(&s.abandoned) > 0 {
+		Warning.Println("waiting for the reply to the abandoned command")
+	}
+
+	go func() {
+		start := time.Now()
+		err := s.monitor.Run(cmd, res)
+		debugCommand(cmd, start, err)
+		if !atomic.CompareAndSwapInt32(&done, 0, 1) {
+			atomic.AddInt32(&s.abandoned, -1)
+		}
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if isConnectionClosed(err) {
+			return ErrConnectionClosed
+		}
+		return err
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&done, 0, 1) {
+			atomic.AddInt32(&s.abandoned, 1)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrCommandTimeout
+		}
+		return ErrCommandInterrupted
+	}
+}
+
+// runWithRetry executes the command like run, but retries it
+// up to retryCount times if a transient I/O error occurs.
+// QMP errors are never retried.
+func (s *QMPShell) runWithRetry(ctx context.Context, cmd *QMPCommand, res interface{}) error {
+	for attempt := 1; ; attempt++ {
+		err := s.run(ctx, cmd, res)
+		if err == nil || attempt > s.retryCount || !isTransientError(err) {
+			return err
+		}
+
+		Debug.Printf("%s: %s, retrying in %s (%d/%d)\n", cmd.Name, err, s.retryDelay, attempt, s.retryCount)
+
+		select {
+		case <-time.After(s.retryDelay):
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrCommandTimeout
+			}
+			return ErrCommandInterrupted
+		}
+	}
+}
+
+// isTransientError returns true if the error is an I/O error
+// (e.g. a timeout) that does not mean that the connection is lost.
+func isTransientError(err error) bool {
+	var nerr net.Error
+
+	return errors.As(err, &nerr) && !isConnectionClosed(err)
+}
+
+// isConnectionClosed returns true if the error means
+// that the connection to QEMU is lost.
+func isConnectionClosed(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case err == io.EOF, qmp.IsSocketClosed(err), qmp.IsSocketNotAvailable(err):
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// interruptContext returns a context that is cancelled
+// when SIGINT is received (i.e. Ctrl-C is pressed
+// while a command is running).
+func interruptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	sigc := make(chan os.Signal, 1)
+
+	signal.Notify(sigc, os.Interrupt)
+
+	go func() {
+		select {
+		case <-sigc:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigc)
+		cancel()
 	}
 }
 
 func (s *QMPShell) buildQMPCommand(cmdline string) (*QMPCommand, error) {
+	if err := checkBalance(cmdline); err != nil {
+		return nil, err
+	}
+
 	cmdargs := s.splitString(cmdline, ' ')
 
 	if len(cmdargs) == 0 {
@@ -225,25 +1198,65 @@ func (s *QMPShell) buildQMPCommand(cmdline string) (*QMPCommand, error) {
 
 	m := make(map[string]interface{})
 
+	// Position of the current argument in the command line
+	var pos int
+
+	// None of the values of sensitive commands are remembered
+	// for completion, see rememberArgValue
+	private := s.isPrivate(cmdline)
+
 	for _, arg := range cmdargs[1:] {
+		if i := strings.Index(cmdline[pos:], arg); i != -1 {
+			pos += i
+		}
+
 		parts := s.splitString(arg, '=')
 
 		if len(parts) != 2 || len(parts[1]) == 0 {
 			return nil, ErrBadCommandFormat
 		}
 
+		valuePos := pos + strings.Index(arg, parts[1])
+		if len(parts[1]) > 0 && strings.ContainsRune("\"'", rune(parts[1][0])) {
+			valuePos++
+		}
+
+		// Quoting the value suppresses the path expansion
+		quoted := strings.ContainsRune("\"'", rune(parts[1][0]))
+
 		parts[1] = strings.Trim(parts[1], "\"'")
 
+		if !quoted && s.isPathArgument(cmdargs[0], parts[0]) {
+			if path := expandPath(parts[1]); path != parts[1] {
+				Warning.Printf("%s expanded to %s", parts[0], path)
+				parts[1] = path
+			}
+		}
+
+		if !private {
+			s.rememberArgValue(parts[0], parts[1])
+		}
+
 		switch {
 		case strings.ToLower(parts[1]) == "true":
 			m[parts[0]] = true
 		case strings.ToLower(parts[1]) == "false":
 			m[parts[0]] = false
+		case !quoted && strings.ToLower(parts[1]) == "null":
+			m[parts[0]] = nil
 		case parts[1][0] == '{' || parts[1][0] == '[':
+			data := parts[1]
+			if s.relaxedJSON {
+				data = relaxJSON(data)
+			}
 			var value interface{}
-			fmt.Println(parts[1])
-			if err := json.Unmarshal([]byte(string(parts[1])), &value); err != nil {
-				return nil, fmt.Errorf("JSON parsing error: %s", err)
+			if err := decodeJSON([]byte(data), &value); err != nil {
+				msg := fmt.Sprintf("JSON parsing error in argument %s: %s", parts[0], err)
+				// The offset is only meaningful for the original value
+				if offset := jsonErrorOffset(err); offset >= 0 && data == parts[1] {
+					return nil, caretError(msg, cmdline, valuePos+offset)
+				}
+				return nil, fmt.Errorf("%s", msg)
 			}
 			m[parts[0]] = value
 		default:
@@ -253,6 +1266,8 @@ func (s *QMPShell) buildQMPCommand(cmdline string) (*QMPCommand, error) {
 				m[parts[0]] = parts[1]
 			}
 		}
+
+		pos += len(arg)
 	}
 
 	return &QMPCommand{cmdargs[0], m}, nil
@@ -260,8 +1275,16 @@ func (s *QMPShell) buildQMPCommand(cmdline string) (*QMPCommand, error) {
 
 func (s *QMPShell) splitString(str string, sep rune) []string {
 	lastQuote := rune(0)
+	escaped := false
 	f := func(c rune) bool {
 		switch {
+		case escaped:
+			escaped = false
+			return false
+		case lastQuote != rune(0) && c == '\\':
+			// Escaped quotes do not end the string, see quoteState
+			escaped = true
+			return false
 		case c == lastQuote:
 			lastQuote = rune(0)
 			return false
@@ -283,101 +1306,123 @@ func (s *QMPShell) splitString(str string, sep rune) []string {
 }
 
 type HMPShell struct {
-	QMPShell
+	*QMPShell
 }
 
-func NewHMPShell(socket string) (*HMPShell, error) {
-	shell, err := NewQMPShell(socket)
+func NewHMPShell(socket string, opts *Options) (*HMPShell, error) {
+	shell, err := NewQMPShell(socket, opts)
 	if err != nil {
 		return nil, err
 	}
 
 	shell.isHMP = true
-	shell.prompt = fmt.Sprintf("hmp_shell/%s> ", shell.vmname)
-	shell.banner = "Welcome to the HMP low-level shell"
-
-	cmdlist := []string{}
-
-	if s, err := shell.executeCommand("help"); err != nil {
-		return nil, fmt.Errorf("cannot build the QMP command list: %s", err)
-	} else {
-		for _, line := range strings.Split(s, "\r\n") {
-			if !(len(line) > 0 && line[0] != '[' && line[0] != '\t') {
-				continue
-			}
-
-			// Drop arguments and help text
-			name := strings.Fields(line)[0]
 
-			if name == "info" {
-				continue
-			}
+	if shell.completion != completionNone {
+		shell.line.SetWordCompleter(shell.completeHMP)
 
-			if strings.Index(line, "|") != -1 {
-				// Command in the form 'foobar|f' or 'f|foobar',
-				// take the full name
-				nn := strings.Split(name, "|")
-				if len(nn[0]) == 1 {
-					name = nn[1]
-				} else {
-					name = nn[0]
-				}
-			}
-
-			cmdlist = append(cmdlist, name, "help "+name)
-		}
+		// Building the command list takes a while,
+		// so the shell is started without waiting for it
+		go shell.loadHMPCommands()
 	}
 
-	if s, err := shell.executeCommand("info"); err != nil {
-		return nil, fmt.Errorf("cannot build the QMP command list: %s", err)
-	} else {
-		for _, line := range strings.Split(s, "\r\n") {
-			if !(len(line) > 0 && len(strings.Fields(line)) >= 2) {
-				continue
-			}
-			cmdlist = append(cmdlist, "info "+strings.Fields(line)[1])
-		}
-	}
-
-	sort.Strings(cmdlist)
-
-	shell.line.SetCompleter(func(line string) (c []string) {
-		for _, n := range cmdlist {
-			if strings.HasPrefix(n, strings.ToLower(line)) {
-				c = append(c, n)
-			}
-		}
-		return
-	})
-
-	return &HMPShell{*shell}, nil
+	return &HMPShell{shell}, nil
 }
 
 func printUsage() {
-	s := fmt.Sprintf("Usage:\n  %s [-H] <UNIX socket path>\n\n", filepath.Base(os.Args[0]))
+	s := fmt.Sprintf("Usage:\n  %s [options] <UNIX socket path>\n\n", filepath.Base(os.Args[0]))
 	s += "Options:\n"
-	s += "  -H    run the HMP shell instead QMP\n"
-	fmt.Fprintf(os.Stderr, s)
-	os.Exit(2)
+	s += "  -H                      run the HMP shell instead QMP\n"
+	s += "  -c <command>            execute the command and exit\n"
+	s += "  -assert <path>=<value>  check the result of -c (e.g. '.status=\"running\"'), can be repeated\n"
+	s += "  -abstract               the socket is in the Linux abstract namespace (also \"@name\")\n"
+	s += "  -pid-to-socket <template>\n"
+	s += "                          the argument is a PID file, the socket is the template with %d replaced by the PID\n"
+	s += "  -ssh <[user@]host>      connect to the socket on the remote host through an SSH tunnel\n"
+	s += "  -ssh-key <file>         private key for -ssh instead of the agent and the default keys\n"
+	s += "  -vm-name-filter <glob>  refuse to connect if the VM name does not match the pattern\n"
+	s += "  -yes                    do not ask for a confirmation of dangerous commands\n"
+	s += "  -safe                   refuse dangerous commands in the non-interactive modes\n"
+	s += "  -history <path>         use the specified history file instead of the per-VM one\n"
+	s += "  -no-history             do not load and save the history file\n"
+	s += "  -max-history-bytes <n>  limit the size of the history file (default 1 MiB, 0 = no limit)\n"
+	s += "  -keepalive <interval>   check the connection periodically (e.g. 30s)\n"
+	s += "  -cmd-timeout <duration> stop waiting for a command result after the timeout (e.g. 1m)\n"
+	s += "  -probe-timeout <duration>\n"
+	s += "                          wait for the QMP greeting on connection (default 5s, 0 = do not check)\n"
+	s += "  -retry-count <N>        retry commands failed with I/O errors N times (default 0)\n"
+	s += "  -retry-delay <duration> delay between the retries (default 1s)\n"
+	s += "  -run-init <file>        execute commands from the file before the first prompt\n"
+	s += "  -decode-base64 <field-path>[:<file>],...\n"
+	s += "                          decode base64 blobs in results and show a hexdump (or save to the file)\n"
+	s += "  -max-field <bytes>      truncate longer strings of results for display\n"
+	s += "  -quiet-events           do not print the received events when Enter is pressed at an empty prompt\n"
+	s += "  -show-greeting          print the QMP greeting (version and capabilities) on start\n"
+	s += "  -prompt <template>      prompt with placeholders: {name}, {mode}, {version}, {status}, {socket}, {time}\n"
+	s += "  -banner <template>      first line printed on start, with the same placeholders as -prompt;\n"
+	s += "                          an empty value suppresses it\n"
+	s += "  -humanize               annotate large integers of results with sizes (e.g. 4.0 GiB)\n"
+	s += "  -raw                    print results exactly as received from QEMU\n"
+	s += "  -json                   print each result or error as a single-line JSON record\n"
+	s += "  -envelope               like -json, but also with the QMP command, duration and timestamp\n"
+	s += "  -completion-engine <engine>\n"
+	s += "                          names-only (command names), schema (also arguments and enum values) or none\n"
+	s += "  -command-prefix <prefix>\n"
+	s += "                          complete only the commands starting with the prefix (e.g. block)\n"
+	s += "  -ctrlc abort|clear      Ctrl-C at the prompt ends the shell (default) or only clears the line\n"
+	s += "  -log-level <level>      show the internal messages of the level: error, warn (default), info or debug\n"
+	s += "  -color <scheme>         color scheme of JSON results: default, dark, light or none\n"
+	s += "  -events                 print the received events as JSON lines until the connection is closed\n"
+	s += "  -events-filter <glob>   print only the events of the matching types (e.g. 'BLOCK_JOB_*')\n"
+	s += "  -commands-fd <N>        read commands from the file descriptor until EOF\n"
+	s += "  -commands-fifo <path>   read commands from the named pipe until EOF\n"
+	s += "  -results-fd <N>         write results of -commands-fd/-fifo to the file descriptor\n"
+	s += "  -results-fifo <path>    write results of -commands-fd/-fifo to the named pipe\n"
+	s += "  -record <file>          record the commands of the session to the file\n"
+	s += "  -profile-output <file>  write the timings of the commands to the CSV file\n"
+	s += "  -replay <file>          execute the commands recorded with -record and exit\n"
+	s += "  -replay-delay <duration>\n"
+	s += "                          delay between the replayed commands (default 500ms)\n"
+	s += "  -parallel <N>           replay up to N commands at once, without the delay\n"
+	s += "  -import-schema <file>   load the QMP schema from the file instead of querying QEMU\n"
+	s += "  -strict                 also reject unknown commands\n"
+	s += "  -no-validate            do not validate arguments against the schema before sending\n"
+	s += "  -relaxed-json           allow unquoted keys, single quotes and trailing commas in JSON values\n"
+	s += "  -no-deprecation-warnings\n"
+	s += "                          do not warn about deprecated commands and arguments\n"
+	s += "\nPasted multi-line JSON is read with the '... ' prompt until all brackets are closed.\n"
+	s += "Bracketed paste is not supported, so a large paste is echoed and redrawn key by key;\n"
+	s += "use /edit, -c or -commands-fd for large input.\n"
+	fmt.Fprint(os.Stderr, s)
+	os.Exit(ExitUsage)
 }
 
 type Shell interface {
 	Serve() error
+	ServeContext(context.Context) error
+
+	VMName() string
 
 	Execute(string) (string, error)
 
+	Replay(string, time.Duration, int) (int, error)
+	ServeCommands(io.Reader, io.Writer) error
+	StreamEvents(context.Context, io.Writer, string) error
+
+	LastResult() json.RawMessage
+
 	LoadHistory(string) error
 	SaveHistory(string) error
+	SetHistoryFile(string)
 
 	Close()
 }
 
-func isatty() bool {
+func isatty(f *os.File) bool {
 	var termios syscall.Termios
 
 	_, _, err := syscall.Syscall6(
 		syscall.SYS_IOCTL,
-		os.Stdin.Fd(),
+		f.Fd(),
 		uintptr(syscall.TCGETS),
 		uintptr(unsafe.Pointer(&termios)),
 		0,
@@ -387,73 +1432,429 @@ func isatty() bool {
 	return err == 0
 }
 
+// serveCommands runs the shell as a command proxy: the commands are read
+// from the file descriptor or FIFO and the results are written to another
+// one (stdout by default) until EOF.
+func serveCommands(shell Shell, commandsFd int, commandsFifo string, resultsFd int, resultsFifo string) error {
+	var r io.ReadCloser
+	var w io.WriteCloser = os.Stdout
+
+	// Opening a FIFO blocks until the other end is opened
+	switch {
+	case len(commandsFifo) > 0:
+		f, err := os.Open(commandsFifo)
+		if err != nil {
+			return err
+		}
+		r = f
+	default:
+		r = os.NewFile(uintptr(commandsFd), "commands")
+	}
+	defer r.Close()
+
+	switch {
+	case len(resultsFifo) > 0:
+		f, err := os.OpenFile(resultsFifo, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		w = f
+		defer w.Close()
+	case resultsFd >= 0:
+		w = os.NewFile(uintptr(resultsFd), "results")
+		defer w.Close()
+	}
+
+	return shell.ServeCommands(r, w)
+}
+
+// handleSignals saves the history (if histfile is not empty)
+// and closes the shell when SIGTERM or SIGHUP is received.
+func handleSignals(shell Shell, histfile string) {
+	sigc := make(chan os.Signal, 1)
+
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		sig := <-sigc
+
+		if len(histfile) > 0 {
+			if err := shell.SaveHistory(histfile); err != nil {
+				Error.Println(err)
+			}
+		}
+
+		// Closing the line editor restores the terminal state.
+		// But the monitor may be busy with a running command,
+		// so do not wait for it too long
+		done := make(chan struct{})
+
+		go func() {
+			shell.Close()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+		}
+
+		exit(128 + int(sig.(syscall.Signal)))
+	}()
+}
+
+var (
+	exitHooks   []func()
+	exitHooksMu sync.Mutex
+)
+
+// atExit registers a function to be called by exit,
+// e.g. to stop a helper process started by the shell.
+func atExit(fn func()) {
+	exitHooksMu.Lock()
+	exitHooks = append(exitHooks, fn)
+	exitHooksMu.Unlock()
+}
+
+// exit runs the registered hooks in the reverse order
+// and exits with the given code.
+func exit(code int) {
+	exitHooksMu.Lock()
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	exitHooksMu.Unlock()
+
+	os.Exit(code)
+}
+
+// queryCommandList returns the sorted list
+// of the commands supported by QEMU.
+func queryCommandList(run func(cmd, res interface{}) error) ([]string, error) {
+	qmpCommands := []struct {
+		Name string `json:"name"`
+	}{}
+
+	if err := run(QMPCommand{"query-commands", nil}, &qmpCommands); err != nil {
+		return nil, fmt.Errorf("cannot build the QMP command list: %s", err)
+	}
+
+	cmdlist := make([]string, 0, len(qmpCommands))
+
+	for _, cmd := range qmpCommands {
+		cmdlist = append(cmdlist, cmd.Name)
+	}
+
+	sort.Strings(cmdlist)
+
+	return cmdlist, nil
+}
+
+// querySchema returns the QAPI schema or nil if it is not available.
+// Older QEMU versions do not support query-qmp-schema,
+// so the shell can work without it.
+func querySchema(run func(cmd, res interface{}) error) *Schema {
+	entities := []SchemaEntity{}
+
+	if err := run(QMPCommand{"query-qmp-schema", nil}, &entities); err != nil {
+		return nil
+	}
+
+	return NewSchema(entities)
+}
+
+// isCommandNotFound reports whether the error
+// is returned by QEMU for an unknown command.
+func isCommandNotFound(err error) bool {
+	e, ok := err.(*qmp.GenericError)
+	return ok && e.Class == "CommandNotFound"
+}
+
+// versionLess reports whether the version a is older than b.
+func versionLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// fatal prints the error and exits with the given code.
+func fatal(code int, v ...interface{}) {
+	Error.Println(v...)
+	exit(code)
+}
+
+// commandExitCode returns the exit code for the error of a command.
+func commandExitCode(err error) int {
+	if err == ErrConnectionClosed {
+		return ExitConnection
+	}
+	return ExitCommand
+}
+
 func init() {
 	flag.Usage = printUsage
 }
 
 func main() {
 	var hmpMode bool
+	var histfile string
+	var noHistory bool
+	var command string
+	var replayFile string
+	var abstract bool
+	var pidTemplate string
+	var commandsFd, resultsFd = -1, -1
+	var commandsFifo, resultsFifo string
+	var replayDelay = 500 * time.Millisecond
+	var replayParallel = 1
+	var assertSpecs stringList
+	var eventsMode bool
+	var eventsFilter string
+	var logLevel = logWarn
+
+	opts := Options{
+		RetryDelay:      time.Second,
+		MaxHistoryBytes: 1 << 20,
+		ProbeTimeout:    5 * time.Second,
+		CtrlC:           ctrlcAbort,
+	}
+
+	// JSON results are highlighted only on terminals by default
+	if isatty(os.Stdout) {
+		opts.ColorScheme = "default"
+	}
 
 	flag.BoolVar(&hmpMode, "H", hmpMode, "")
+	flag.BoolVar(&abstract, "abstract", abstract, "")
+	flag.StringVar(&pidTemplate, "pid-to-socket", pidTemplate, "")
+	flag.StringVar(&command, "c", command, "")
+	flag.StringVar(&histfile, "history", histfile, "")
+	flag.BoolVar(&noHistory, "no-history", noHistory, "")
+	flag.Int64Var(&opts.MaxHistoryBytes, "max-history-bytes", opts.MaxHistoryBytes, "")
+	flag.StringVar(&opts.SchemaFile, "import-schema", opts.SchemaFile, "")
+	flag.BoolVar(&opts.Strict, "strict", opts.Strict, "")
+	flag.BoolVar(&opts.NoValidate, "no-validate", opts.NoValidate, "")
+	flag.BoolVar(&opts.NoDeprecationWarnings, "no-deprecation-warnings", opts.NoDeprecationWarnings, "")
+	flag.DurationVar(&opts.Keepalive, "keepalive", opts.Keepalive, "")
+	flag.DurationVar(&opts.CommandTimeout, "cmd-timeout", opts.CommandTimeout, "")
+	flag.DurationVar(&opts.ProbeTimeout, "probe-timeout", opts.ProbeTimeout, "")
+	flag.StringVar(&opts.InitFile, "run-init", opts.InitFile, "")
+	flag.StringVar(&opts.DecodeBase64, "decode-base64", opts.DecodeBase64, "")
+	flag.IntVar(&opts.MaxField, "max-field", opts.MaxField, "")
+	flag.StringVar(&opts.ColorScheme, "color", opts.ColorScheme, "")
+	flag.StringVar(&opts.RecordFile, "record", opts.RecordFile, "")
+	flag.StringVar(&opts.ProfileFile, "profile-output", opts.ProfileFile, "")
+	flag.BoolVar(&opts.Humanize, "humanize", opts.Humanize, "")
+	flag.BoolVar(&opts.Raw, "raw", opts.Raw, "")
+	flag.BoolVar(&opts.JSON, "json", opts.JSON, "")
+	flag.BoolVar(&opts.Envelope, "envelope", opts.Envelope, "")
+	flag.BoolVar(&opts.Yes, "yes", opts.Yes, "")
+	flag.BoolVar(&opts.Safe, "safe", opts.Safe, "")
+	flag.StringVar(&opts.Prompt, "prompt", opts.Prompt, "")
+	flag.StringVar(&opts.Banner, "banner", opts.Banner, "")
+	flag.StringVar(&opts.CompletionEngine, "completion-engine", opts.CompletionEngine, "")
+	flag.StringVar(&opts.CommandPrefix, "command-prefix", opts.CommandPrefix, "")
+	flag.StringVar(&opts.CtrlC, "ctrlc", opts.CtrlC, "")
+	flag.StringVar(&opts.VMNameFilter, "vm-name-filter", opts.VMNameFilter, "")
+	flag.BoolVar(&opts.RelaxedJSON, "relaxed-json", opts.RelaxedJSON, "")
+	flag.StringVar(&opts.SSHDest, "ssh", opts.SSHDest, "")
+	flag.StringVar(&opts.SSHKey, "ssh-key", opts.SSHKey, "")
+	flag.BoolVar(&opts.ShowGreeting, "show-greeting", opts.ShowGreeting, "")
+	flag.BoolVar(&opts.QuietEvents, "quiet-events", opts.QuietEvents, "")
+	flag.IntVar(&opts.RetryCount, "retry-count", opts.RetryCount, "")
+	flag.DurationVar(&opts.RetryDelay, "retry-delay", opts.RetryDelay, "")
+	flag.StringVar(&replayFile, "replay", replayFile, "")
+	flag.IntVar(&commandsFd, "commands-fd", commandsFd, "")
+	flag.StringVar(&commandsFifo, "commands-fifo", commandsFifo, "")
+	flag.IntVar(&resultsFd, "results-fd", resultsFd, "")
+	flag.StringVar(&resultsFifo, "results-fifo", resultsFifo, "")
+	flag.DurationVar(&replayDelay, "replay-delay", replayDelay, "")
+	flag.IntVar(&replayParallel, "parallel", replayParallel, "")
+	flag.Var(&assertSpecs, "assert", "")
+	flag.BoolVar(&eventsMode, "events", eventsMode, "")
+	flag.StringVar(&eventsFilter, "events-filter", eventsFilter, "")
+	flag.StringVar(&logLevel, "log-level", logLevel, "")
 	flag.Parse()
 
 	if flag.NArg() != 1 {
 		flag.Usage()
 	}
 
+	if err := setLogLevel(logLevel); err != nil {
+		fatal(ExitUsage, err)
+	}
+
+	// An explicitly empty banner suppresses it
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "banner" && len(opts.Banner) == 0 {
+			opts.NoBanner = true
+		}
+	})
+
+	var assertions []*assertion
+
+	for _, spec := range assertSpecs {
+		a, err := parseAssertion(spec)
+		if err != nil {
+			fatal(ExitUsage, err)
+		}
+		assertions = append(assertions, a)
+	}
+
+	if len(assertions) > 0 && (len(replayFile) > 0 || commandsFd >= 0 || len(commandsFifo) > 0) {
+		fatal(ExitUsage, "-assert can only be used with -c")
+	}
+
+	switch {
+	case eventsMode && (len(command) > 0 || len(replayFile) > 0 || commandsFd >= 0 || len(commandsFifo) > 0):
+		fatal(ExitUsage, "-events cannot be used with -c, -replay and -commands-fd/-fifo")
+	case len(eventsFilter) > 0 && !eventsMode:
+		fatal(ExitUsage, "-events-filter can only be used with -events")
+	case replayParallel < 1:
+		fatal(ExitUsage, "-parallel must be at least 1")
+	case replayParallel > 1 && len(replayFile) == 0:
+		fatal(ExitUsage, "-parallel can only be used with -replay")
+	case replayParallel > 1 && opts.Envelope:
+		fatal(ExitUsage, "-parallel cannot be used with -envelope")
+	}
+
 	vmsocket := flag.Arg(0)
 
+	// The argument is the PID file then
+	if len(pidTemplate) > 0 {
+		switch {
+		case !strings.Contains(pidTemplate, "%d"):
+			fatal(ExitUsage, errors.New("-pid-to-socket: the template must contain %d"))
+		case len(opts.SSHDest) > 0:
+			fatal(ExitUsage, "-pid-to-socket cannot be used with -ssh")
+		}
+		var err error
+		if vmsocket, err = socketFromPidfile(pidTemplate, vmsocket); err != nil {
+			fatal(ExitConnection, err)
+		}
+	}
+
+	vmsocket = socketAddress(vmsocket, abstract)
+
 	var shell Shell
 	var err error
 
 	if hmpMode {
-		shell, err = NewHMPShell(vmsocket)
-		if err != nil {
-			Error.Fatalln(err)
-		}
+		shell, err = NewHMPShell(vmsocket, &opts)
 	} else {
-		shell, err = NewQMPShell(vmsocket)
-		if err != nil {
-			Error.Fatalln(err)
-		}
+		shell, err = NewQMPShell(vmsocket, &opts)
+	}
+	if err != nil {
+		fatal(ExitConnection, err)
 	}
 	defer shell.Close()
 
-	if !isatty() {
+	if eventsMode {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+		go func() {
+			<-sigc
+			cancel()
+		}()
+
+		switch err := shell.StreamEvents(ctx, os.Stdout, eventsFilter); {
+		case err == ErrConnectionClosed:
+			fatal(ExitConnection, err)
+		case err != nil:
+			fatal(ExitFailure, err)
+		}
+		exit(ExitOK)
+	}
+
+	if commandsFd >= 0 || len(commandsFifo) > 0 {
+		switch err := serveCommands(shell, commandsFd, commandsFifo, resultsFd, resultsFifo); {
+		case err == ErrConnectionClosed:
+			fatal(ExitConnection, err)
+		case err != nil:
+			fatal(ExitFailure, err)
+		}
+		exit(ExitOK)
+	}
+
+	if len(command) == 0 && len(replayFile) == 0 && !isatty(os.Stdin) {
 		r := bufio.NewReader(os.Stdin)
-		cmdline, err := r.ReadString('\n')
-		if err != nil {
-			Error.Fatalln("cannot read command from stdin:", err)
+		if command, err = r.ReadString('\n'); err != nil {
+			fatal(ExitFailure, "cannot read command from stdin:", err)
 		}
-		if res, err := shell.Execute(cmdline); err == nil {
+	}
+
+	if len(command) > 0 {
+		res, err := shell.Execute(command)
+		if len(res) > 0 {
 			fmt.Println(res)
-		} else {
-			Error.Fatalln(err)
 		}
-		os.Exit(0)
+		switch {
+		case err == nil:
+		case opts.JSON || opts.Envelope:
+			// The error is already in the record
+			exit(commandExitCode(err))
+		default:
+			fatal(commandExitCode(err), err)
+		}
+		if len(assertions) > 0 && !checkAssertions(assertions, shell.LastResult()) {
+			exit(ExitFailure)
+		}
+		exit(ExitOK)
 	}
 
-	histfile := "/dev/null"
-	if homedir, isSet := os.LookupEnv("HOME"); isSet {
-		if hmpMode {
-			histfile = filepath.Join(homedir, ".hmpshell_history")
-		} else {
-			histfile = filepath.Join(homedir, ".qmpshell_history")
+	if len(assertions) > 0 {
+		fatal(ExitUsage, "-assert can only be used with -c")
+	}
+
+	if len(replayFile) > 0 {
+		failed, err := shell.Replay(replayFile, replayDelay, replayParallel)
+		switch {
+		case err == ErrConnectionClosed || err == ErrCommandInterrupted:
+			fatal(commandExitCode(err), err)
+		case err != nil:
+			fatal(ExitFailure, err)
+		case failed > 0:
+			fatal(ExitCommand, fmt.Sprintf("%s: %d command(s) failed", replayFile, failed))
 		}
+		exit(ExitOK)
 	}
 
-	// Load history
-	if err := shell.LoadHistory(histfile); err != nil {
-		Error.Println(err)
+	if noHistory {
+		histfile = ""
+	} else {
+		histfiles := []string{histfile}
+		if len(histfile) == 0 {
+			histfiles, histfile = historyFiles(hmpMode, shell.VMName())
+		}
+
+		// Load history
+		for _, fname := range histfiles {
+			if err := shell.LoadHistory(fname); err != nil {
+				Error.Println(err)
+			}
+		}
+
+		shell.SetHistoryFile(histfile)
 	}
 
+	// Save history and restore the terminal on termination
+	handleSignals(shell, histfile)
+
 	// Main loop
 	if err := shell.Serve(); err != nil {
 		Error.Println(err)
 	}
 
 	// Save history
-	if err := shell.SaveHistory(histfile); err != nil {
-		Error.Println(err)
+	if len(histfile) > 0 {
+		if err := shell.SaveHistory(histfile); err != nil {
+			Error.Println(err)
+		}
 	}
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeMonitor is a minimal QMP server for the tests. It greets each
+// client, accepts qmp_capabilities and answers the other commands
+// with the fixed results, query-commands lists them. Other commands
+// fail with CommandNotFound. The commands with the fakeNoReply
+// result are never answered, like by a hung QEMU.
+type fakeMonitor struct {
+	path    string
+	l       net.Listener
+	results map[string]interface{}
+	active  int32 // number of the connected clients
+}
+
+type fakeNoReply struct{}
+
+func newFakeMonitor(t *testing.T, results map[string]interface{}) *fakeMonitor {
+	path := fmt.Sprintf("@qmp-shell-test-%d-%s", os.Getpid(), t.Name())
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("abstract sockets are not supported: %s", err)
+	}
+
+	m := fakeMonitor{path: path, l: l, results: results}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+
+	return &m
+}
+
+// defaultFakeResults returns the results of the commands
+// that are run by NewQMPShell.
+func defaultFakeResults() map[string]interface{} {
+	return map[string]interface{}{
+		"query-name":    map[string]interface{}{"name": "alice"},
+		"query-version": map[string]interface{}{"qemu": map[string]int{"major": 6, "minor": 2, "micro": 0}, "package": ""},
+		"query-status":  map[string]interface{}{"running": true, "status": "running"},
+	}
+}
+
+func (m *fakeMonitor) serve(conn net.Conn) {
+	atomic.AddInt32(&m.active, 1)
+	defer atomic.AddInt32(&m.active, -1)
+
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+
+	send := func(v interface{}) bool {
+		b, _ := json.Marshal(v)
+		w.Write(append(b, '\n'))
+		return w.Flush() == nil
+	}
+
+	if !send(map[string]interface{}{"QMP": map[string]interface{}{"version": m.results["query-version"], "capabilities": []string{}}}) {
+		return
+	}
+
+	dec := json.NewDecoder(conn)
+
+	for {
+		var req struct {
+			Execute string `json:"execute"`
+		}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+
+		var res interface{}
+
+		switch req.Execute {
+		case "qmp_capabilities":
+			res = struct{}{}
+		case "query-commands":
+			names := []string{"qmp_capabilities", "query-commands"}
+			for name := range m.results {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			var cmds []map[string]string
+			for _, name := range names {
+				cmds = append(cmds, map[string]string{"name": name})
+			}
+			res = cmds
+		default:
+			var ok bool
+			if res, ok = m.results[req.Execute]; !ok {
+				send(map[string]interface{}{"error": map[string]string{"class": "CommandNotFound", "desc": "The command " + req.Execute + " has not been found"}})
+				continue
+			}
+			if _, ok := res.(fakeNoReply); ok {
+				continue
+			}
+		}
+
+		if !send(map[string]interface{}{"return": res}) {
+			return
+		}
+	}
+}
+
+func (m *fakeMonitor) Close() {
+	m.l.Close()
+}
+
+func TestExecuteLargeResponse(t *testing.T) {
+	// A schema of about 2 MB, larger than any buffer
+	// the monitor might use to read the responses
+	var schema []SchemaEntity
+
+	for i := 0; i < 10000; i++ {
+		schema = append(schema, SchemaEntity{
+			Name:     fmt.Sprintf("q_obj_object-%d-arg", i),
+			MetaType: "object",
+			Members: []SchemaMember{
+				{Name: "id", Type: "str"},
+				{Name: strings.Repeat("x", 100), Type: "int"},
+			},
+		})
+	}
+
+	results := defaultFakeResults()
+	results["query-qmp-schema"] = schema
+
+	m := newFakeMonitor(t, results)
+	defer m.Close()
+
+	s, err := NewQMPShell(m.path, &Options{})
+	if err != nil {
+		t.Fatalf("NewQMPShell: %s", err)
+	}
+	defer s.Close()
+
+	if s.schema == nil {
+		t.Fatalf("the schema is not loaded")
+	}
+
+	for _, format := range []string{outputJSON, outputRaw} {
+		s.format = format
+
+		res, err := s.executeCommand(context.Background(), "query-qmp-schema")
+		if err != nil {
+			t.Fatalf("query-qmp-schema (%s): %s", format, err)
+		}
+
+		var got []SchemaEntity
+		if err := json.Unmarshal([]byte(res), &got); err != nil {
+			t.Fatalf("query-qmp-schema (%s): the result of %d bytes is not valid JSON: %s", format, len(res), err)
+		}
+		if len(got) != len(schema) || got[len(got)-1].Name != schema[len(schema)-1].Name {
+			t.Fatalf("query-qmp-schema (%s): got %d entities, want %d", format, len(got), len(schema))
+		}
+	}
+}
+
+func TestNewQMPShellWithoutQueryName(t *testing.T) {
+	// Like qemu-storage-daemon: no query-name and no query-status
+	results := defaultFakeResults()
+	delete(results, "query-name")
+	delete(results, "query-status")
+	results["query-version"] = map[string]interface{}{"package": ""}
+	results["query-block-jobs"] = []interface{}{}
+
+	m := newFakeMonitor(t, results)
+	defer m.Close()
+
+	s, err := NewQMPShell(m.path, &Options{})
+	if err != nil {
+		t.Fatalf("NewQMPShell: %s", err)
+	}
+	defer s.Close()
+
+	if s.vmname != "" || s.qemuVer != "unknown" {
+		t.Errorf("got VM name %q and version %q, want an empty name and unknown version", s.vmname, s.qemuVer)
+	}
+
+	if prompt := s.expandTemplate(s.prompt); prompt != "qmp_shell> " {
+		t.Errorf("got prompt %q, want %q", prompt, "qmp_shell> ")
+	}
+
+	if !s.hasCommand("query-block-jobs") {
+		t.Errorf("the command list is not built: %v", s.commands)
+	}
+
+	if _, err := s.executeCommand(context.Background(), "query-block-jobs"); err != nil {
+		t.Errorf("query-block-jobs: %s", err)
+	}
+
+	if _, err := s.executeCommand(context.Background(), "query-name"); !isCommandNotFound(err) {
+		t.Errorf("query-name: got error %v, want CommandNotFound", err)
+	}
+}
+
+func TestNewQMPShellClosesOnError(t *testing.T) {
+	m := newFakeMonitor(t, defaultFakeResults())
+	defer m.Close()
+
+	for _, opts := range []*Options{
+		{VMNameFilter: "bob"},
+		{SchemaFile: "/nonexistent/qmp-schema.json"},
+	} {
+		if _, err := NewQMPShell(m.path, opts); err == nil {
+			t.Fatalf("NewQMPShell(%+v): no error", opts)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(&m.active) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("NewQMPShell(%+v): the monitor is not closed after the error", opts)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	results := defaultFakeResults()
+	results["query-status"] = fakeNoReply{}
+
+	m := newFakeMonitor(t, results)
+	defer m.Close()
+
+	s, err := NewQMPShell(m.path, &Options{Keepalive: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewQMPShell: %s", err)
+	}
+	defer s.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+		s.noticesMu.Lock()
+		notices := s.notices
+		s.noticesMu.Unlock()
+
+		if len(notices) > 0 {
+			if !strings.Contains(notices[0], "no reply to query-status") {
+				t.Fatalf("got notice %q, want a hung monitor notice", notices[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no notice is queued for the hung monitor")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOOBNotAvailable(t *testing.T) {
+	m := newFakeMonitor(t, defaultFakeResults())
+	defer m.Close()
+
+	s, err := NewQMPShell(m.path, &Options{})
+	if err != nil {
+		t.Fatalf("NewQMPShell: %s", err)
+	}
+	defer s.Close()
+
+	if _, err := s.executeCommand(context.Background(), "oob migrate-recover uri=tcp:0:4444"); err != ErrOOBNotAvailable {
+		t.Errorf("got error %v, want %v", err, ErrOOBNotAvailable)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localCommands are the built-in commands that do not interact
+// with QEMU. They are not written to the session record.
+var localCommands = map[string]struct{}{
+	"set":       struct{}{},
+	".timeout":  struct{}{},
+	".commands": struct{}{},
+	".reload":   struct{}{},
+	".format":   struct{}{},
+	".greeting": struct{}{},
+	"alias":     struct{}{},
+	"unalias":   struct{}{},
+	"source":    struct{}{},
+	"oob":       struct{}{},
+
+	"event-stats": struct{}{},
+}
+
+// openRecord creates the file where the commands
+// of the session are recorded.
+func (s *QMPShell) openRecord(fname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("cannot create the record file: %s", err)
+	}
+
+	fmt.Fprintf(f, "# qmp-shell session: %s, QEMU %s, %s\n", s.vmname, s.qemuVer, time.Now().Format(time.RFC3339))
+
+	s.record = f
+
+	return nil
+}
+
+// recordCommand writes the command line to the session record
+// unless it is a command that does not interact with QEMU.
+func (s *QMPShell) recordCommand(cmdline string) {
+	if s.record == nil {
+		return
+	}
+
+	if _, ok := localCommands[strings.SplitN(cmdline, " ", 2)[0]]; ok {
+		return
+	}
+
+	if _, err := fmt.Fprintln(s.record, strings.TrimSpace(cmdline)); err != nil {
+		Error.Println("cannot record the command:", err)
+	}
+}
+
+// Replay executes the commands from the recorded session
+// with the delay between them. Each command is printed
+// before its result. The number of failed commands is returned.
+// If parallel is greater than one, up to parallel commands
+// are sent at once without any delay (see replayParallel).
+func (s *QMPShell) Replay(fname string, delay time.Duration, parallel int) (int, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	ctx, cancel := interruptContext(s.ctx)
+	defer cancel()
+
+	if parallel > 1 {
+		return s.replayParallel(ctx, f, parallel)
+	}
+
+	var failed int
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for first := true; scanner.Scan(); {
+		cmdline := strings.TrimSpace(scanner.Text())
+
+		if len(cmdline) == 0 || strings.HasPrefix(cmdline, "#") {
+			continue
+		}
+
+		if !first {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return failed, ErrCommandInterrupted
+			}
+		}
+		first = false
+
+		fmt.Println(s.renderPrompt() + cmdline)
+
+		res, err := s.executeCommand(ctx, cmdline)
+		if len(res) > 0 {
+			fmt.Println(res)
+		}
+		switch err {
+		case nil:
+			continue
+		case ErrConnectionClosed, ErrCommandInterrupted:
+			return failed + 1, err
+		}
+
+		fmt.Fprintln(os.Stderr, err)
+		failed++
+	}
+
+	return failed, scanner.Err()
+}
+
+// replayParallel executes the commands of the recorded session
+// sending up to n of them at once. The go-qmp monitor serializes
+// the requests and QEMU executes them one by one anyway, so this
+// only saves the round trips between the commands. The commands
+// are parsed and checked in order, the results are printed
+// together with their commands as soon as they are received.
+// Built-in commands and chains are not supported in this mode.
+func (s *QMPShell) replayParallel(ctx context.Context, r io.Reader, n int) (int, error) {
+	var failed int
+	var fatalErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	sem := make(chan struct{}, n)
+
+	// report prints the command with its result under the lock,
+	// so that the outputs of different commands are not mixed
+	report := func(cmdline, res string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		fmt.Println(s.renderPrompt() + cmdline)
+
+		if s.jsonOut {
+			res = s.formatJSONRecord(cmdline, res, err)
+		}
+		if len(res) > 0 {
+			fmt.Println(res)
+		}
+
+		switch err {
+		case nil:
+			return
+		case ErrConnectionClosed, ErrCommandInterrupted:
+			if fatalErr == nil {
+				fatalErr = err
+			}
+		default:
+			fmt.Fprintln(os.Stderr, err)
+		}
+		failed++
+	}
+
+	stopped := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return fatalErr != nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() && !stopped() {
+		cmdline, _ := stripComment(scanner.Text())
+
+		if len(cmdline) == 0 {
+			continue
+		}
+
+		expanded := s.expandAlias(cmdline)
+
+		if cmds, _, err := splitChain(expanded); err != nil || len(cmds) != 1 {
+			report(cmdline, "", fmt.Errorf("command chains cannot be replayed in parallel"))
+			continue
+		}
+
+		stripped, timeout, override, err := parseTimeoutOverride(expanded)
+		if err != nil {
+			report(cmdline, "", err)
+			continue
+		}
+		if !override {
+			timeout = s.cmdTimeout
+		}
+
+		if _, ok := builtinCommands[strings.SplitN(stripped, " ", 2)[0]]; ok {
+			report(cmdline, "", fmt.Errorf("built-in commands cannot be replayed in parallel"))
+			continue
+		}
+
+		cmd, err := s.prepareCommand(stripped)
+		if err != nil {
+			report(cmdline, "", err)
+			continue
+		}
+
+		s.recordCommand(expanded)
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			report(cmdline, "", ErrCommandInterrupted)
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(cmdline string, cmd *QMPCommand, timeout time.Duration) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			raw, err := s.send(ctx, cmd, timeout)
+
+			var res string
+			if err == nil {
+				res, err = s.formatReturn(cmd.Name, raw)
+			}
+
+			report(cmdline, res, err)
+		}(cmdline, cmd, timeout)
+	}
+
+	wg.Wait()
+
+	if fatalErr != nil {
+		return failed, fatalErr
+	}
+
+	return failed, scanner.Err()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReplayLongLines(t *testing.T) {
+	m := newFakeMonitor(t, defaultFakeResults())
+	defer m.Close()
+
+	s, err := NewQMPShell(m.path, &Options{})
+	if err != nil {
+		t.Fatalf("NewQMPShell: %s", err)
+	}
+	defer s.Close()
+
+	f, err := ioutil.TempFile("", "qmp-shell-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// A line longer than the default limit of bufio.Scanner
+	f.WriteString("# " + strings.Repeat("x", 100*1024) + "\nquery-status\n")
+	f.Close()
+
+	for _, parallel := range []int{1, 2} {
+		if failed, err := s.Replay(f.Name(), 0, parallel); failed != 0 || err != nil {
+			t.Errorf("Replay with parallel=%d: %d failed, error %v", parallel, failed, err)
+		}
+	}
+
+	if failed, err := s.runScript(context.Background(), f.Name()); failed != 0 || err != nil {
+		t.Errorf("runScript: %d failed, error %v", failed, err)
+	}
+}
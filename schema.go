@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// SchemaMember describes a member of a QAPI object type
+// or a value of a QAPI enumeration type.
+type SchemaMember struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// Default is present (and always null) only for optional members
+	Default json.RawMessage `json:"default"`
+
+	Features []string `json:"features"`
+}
+
+func (m *SchemaMember) Optional() bool {
+	return m.Default != nil
+}
+
+// SchemaEntity is an element of the query-qmp-schema output.
+// See the SchemaInfo type in qapi/introspect.json for details.
+type SchemaEntity struct {
+	Name     string `json:"name"`
+	MetaType string `json:"meta-type"`
+
+	// meta-type: command
+	ArgType string `json:"arg-type"`
+	RetType string `json:"ret-type"`
+
+	// meta-type: object, enum, alternate
+	Members  []SchemaMember `json:"members"`
+	Tag      string         `json:"tag"`
+	Variants []struct {
+		Case string `json:"case"`
+		Type string `json:"type"`
+	} `json:"variants"`
+
+	// meta-type: enum (older QEMU versions)
+	Values []string `json:"values"`
+
+	// meta-type: array
+	ElementType string `json:"element-type"`
+
+	// meta-type: builtin
+	JSONType string `json:"json-type"`
+
+	Features []string `json:"features"`
+}
+
+// Schema provides access to the QAPI schema
+// returned by the query-qmp-schema command.
+type Schema struct {
+	entities map[string]*SchemaEntity
+}
+
+func NewSchema(entities []SchemaEntity) *Schema {
+	sc := Schema{
+		entities: make(map[string]*SchemaEntity),
+	}
+
+	for i := range entities {
+		sc.entities[entities[i].Name] = &entities[i]
+	}
+
+	return &sc
+}
+
+// LoadSchema reads the schema from a file that contains
+// the output of query-qmp-schema: either the list of entities
+// or the whole QMP response with the "return" field.
+func LoadSchema(fname string) (*Schema, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema file: %s", err)
+	}
+
+	entities := []SchemaEntity{}
+
+	if err := json.Unmarshal(b, &entities); err != nil {
+		resp := struct {
+			Return []SchemaEntity `json:"return"`
+		}{}
+
+		if err := json.Unmarshal(b, &resp); err != nil || resp.Return == nil {
+			return nil, fmt.Errorf("cannot parse schema file %s: not a query-qmp-schema output", fname)
+		}
+
+		entities = resp.Return
+	}
+
+	return NewSchema(entities), nil
+}
+
+// Command returns the schema entity of the given command
+// or nil if there is no such command.
+func (sc *Schema) Command(name string) *SchemaEntity {
+	if e, ok := sc.entities[name]; ok && e.MetaType == "command" {
+		return e
+	}
+	return nil
+}
+
+// Commands returns a sorted list of all command names.
+func (sc *Schema) Commands() []string {
+	var names []string
+
+	for name, e := range sc.entities {
+		if e.MetaType == "command" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Arguments returns the list of arguments of the given command.
+// For commands with a flat union as the argument type
+// the members of all variants are included.
+func (sc *Schema) Arguments(cmdname string) []SchemaMember {
+	cmd := sc.Command(cmdname)
+	if cmd == nil {
+		return nil
+	}
+
+	return sc.members(cmd.ArgType)
+}
+
+// Argument returns the description of the given argument
+// or nil if the command has no such argument.
+func (sc *Schema) Argument(cmdname, argname string) *SchemaMember {
+	for _, m := range sc.Arguments(cmdname) {
+		if m.Name == argname {
+			return &m
+		}
+	}
+	return nil
+}
+
+func (sc *Schema) members(typename string) []SchemaMember {
+	e, ok := sc.entities[typename]
+	if !ok || e.MetaType != "object" {
+		return nil
+	}
+
+	members := make([]SchemaMember, 0, len(e.Members))
+	seen := make(map[string]struct{})
+
+	for _, m := range e.Members {
+		members = append(members, m)
+		seen[m.Name] = struct{}{}
+	}
+
+	for _, v := range e.Variants {
+		for _, m := range sc.members(v.Type) {
+			if _, ok := seen[m.Name]; !ok {
+				members = append(members, m)
+				seen[m.Name] = struct{}{}
+			}
+		}
+	}
+
+	return members
+}
+
+// Discriminator returns the discriminator argument and its values
+// for commands with a flat union as the argument type
+// (e.g. "type" for netdev_add). An empty name is returned
+// for other commands.
+func (sc *Schema) Discriminator(cmdname string) (string, []string) {
+	cmd := sc.Command(cmdname)
+	if cmd == nil {
+		return "", nil
+	}
+
+	e, ok := sc.entities[cmd.ArgType]
+	if !ok || e.MetaType != "object" || len(e.Tag) == 0 {
+		return "", nil
+	}
+
+	cases := make([]string, 0, len(e.Variants))
+	for _, v := range e.Variants {
+		cases = append(cases, v.Case)
+	}
+
+	sort.Strings(cases)
+
+	return e.Tag, cases
+}
+
+// VariantArguments returns the arguments of the command with a flat
+// union as the argument type for the given discriminator value:
+// the common members (except the discriminator) and the members
+// of the selected variant.
+func (sc *Schema) VariantArguments(cmdname, tag string) []SchemaMember {
+	cmd := sc.Command(cmdname)
+	if cmd == nil {
+		return nil
+	}
+
+	e, ok := sc.entities[cmd.ArgType]
+	if !ok || e.MetaType != "object" {
+		return nil
+	}
+
+	var args []SchemaMember
+
+	for _, m := range e.Members {
+		if m.Name != e.Tag {
+			args = append(args, m)
+		}
+	}
+
+	for _, v := range e.Variants {
+		if v.Case == tag {
+			args = append(args, sc.members(v.Type)...)
+		}
+	}
+
+	return args
+}
+
+// MissingArguments returns a sorted list of the required arguments
+// of the given command that are not present in args.
+// For commands with a flat union as the argument type only
+// the members of the variant selected by the discriminator
+// are taken into account.
+func (sc *Schema) MissingArguments(cmdname string, args map[string]interface{}) []string {
+	cmd := sc.Command(cmdname)
+	if cmd == nil {
+		return nil
+	}
+
+	var missing []string
+
+	check := func(members []SchemaMember) {
+		for _, m := range members {
+			if _, ok := args[m.Name]; !ok && !m.Optional() {
+				missing = append(missing, m.Name)
+			}
+		}
+	}
+
+	if e, ok := sc.entities[cmd.ArgType]; ok && e.MetaType == "object" {
+		check(e.Members)
+
+		if tag, ok := args[e.Tag].(string); ok {
+			for _, v := range e.Variants {
+				if v.Case == tag {
+					check(sc.members(v.Type))
+				}
+			}
+		}
+	}
+
+	sort.Strings(missing)
+
+	return missing
+}
+
+// TransactionActions returns a sorted list of the action types
+// supported by the transaction command.
+func (sc *Schema) TransactionActions() []string {
+	arg := sc.Argument("transaction", "actions")
+	if arg == nil {
+		return nil
+	}
+
+	array, ok := sc.entities[arg.Type]
+	if !ok || array.MetaType != "array" {
+		return nil
+	}
+
+	action, ok := sc.entities[array.ElementType]
+	if !ok {
+		return nil
+	}
+
+	names := make([]string, 0, len(action.Variants))
+	for _, v := range action.Variants {
+		names = append(names, v.Case)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Deprecated returns true if the given command or its argument
+// (if argname is not empty) is marked as deprecated.
+func (sc *Schema) Deprecated(cmdname, argname string) bool {
+	if len(argname) == 0 {
+		if cmd := sc.Command(cmdname); cmd != nil {
+			return hasFeature(cmd.Features, "deprecated")
+		}
+		return false
+	}
+
+	if arg := sc.Argument(cmdname, argname); arg != nil {
+		return hasFeature(arg.Features, "deprecated")
+	}
+
+	return false
+}
+
+func hasFeature(features []string, name string) bool {
+	for _, f := range features {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// JSONType returns the JSON type of values of the given QAPI type:
+// string, number, int, boolean, null, object, array or value
+// (when any JSON value is allowed).
+func (sc *Schema) JSONType(typename string) string {
+	e, ok := sc.entities[typename]
+	if !ok {
+		return "value"
+	}
+
+	switch e.MetaType {
+	case "builtin":
+		return e.JSONType
+	case "enum":
+		return "string"
+	case "array":
+		return "array"
+	case "object":
+		return "object"
+	}
+
+	return "value"
+}
+
+// EnumValues returns the list of values of the given enumeration type.
+func (sc *Schema) EnumValues(typename string) []string {
+	e, ok := sc.entities[typename]
+	if !ok || e.MetaType != "enum" {
+		return nil
+	}
+
+	if len(e.Values) > 0 {
+		return e.Values
+	}
+
+	values := make([]string, 0, len(e.Members))
+	for _, m := range e.Members {
+		values = append(values, m.Name)
+	}
+
+	return values
+}
+
+// TypeName returns a human readable name of the given type.
+// Most of the type names in query-qmp-schema are masked,
+// so only builtin types keep their names.
+func (sc *Schema) TypeName(typename string) string {
+	e, ok := sc.entities[typename]
+	if !ok {
+		return typename
+	}
+
+	switch e.MetaType {
+	case "builtin":
+		return e.Name
+	case "enum":
+		values := sc.EnumValues(typename)
+		if len(values) > 8 {
+			values = append(values[:8:8], "...")
+		}
+		return "enum (" + strings.Join(values, "|") + ")"
+	case "array":
+		return "array of " + sc.TypeName(e.ElementType)
+	}
+
+	return e.MetaType
+}
+
+// Synopsis returns a short description of the command arguments:
+// their names, types and optional markers.
+func (sc *Schema) Synopsis(cmdname string) (string, error) {
+	cmd := sc.Command(cmdname)
+	if cmd == nil {
+		return "", fmt.Errorf("unknown command: %s", cmdname)
+	}
+
+	var b strings.Builder
+
+	b.WriteString(cmdname)
+	if hasFeature(cmd.Features, "deprecated") {
+		b.WriteString(" (deprecated)")
+	}
+
+	args := sc.Arguments(cmdname)
+	if len(args) == 0 {
+		b.WriteString("\n  no arguments")
+	}
+
+	for _, m := range args {
+		fmt.Fprintf(&b, "\n  %s: %s", m.Name, sc.TypeName(m.Type))
+		if m.Optional() {
+			b.WriteString(", optional")
+		}
+		if hasFeature(m.Features, "deprecated") {
+			b.WriteString(", deprecated")
+		}
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// screenshot implements the "screenshot [path]" command. It runs
+// screendump to a temporary file and saves the image as PNG
+// to the path or to a timestamped file in the current directory.
+// Older QEMU versions write only PPM, so the image is converted.
+func (s *QMPShell) screenshot(ctx context.Context, args []string) (string, error) {
+	if len(args) > 2 {
+		return "", fmt.Errorf("usage: screenshot [path]")
+	}
+
+	// QEMU writes the file on its own host
+	if s.tunnel != nil {
+		return "", fmt.Errorf("the monitor is on a remote host, the screenshot would be saved there: use screendump filename=<path on %s>", s.tunnel.dest)
+	}
+
+	path := time.Now().Format("screenshot-20060102-150405.png")
+	if len(args) == 2 {
+		path = args[1]
+	}
+
+	dir, err := ioutil.TempDir("", "qmp-shell-screendump")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpfile := filepath.Join(dir, "screen")
+
+	cmdargs := map[string]interface{}{"filename": tmpfile}
+
+	if s.screendumpPNG() {
+		cmdargs["format"] = "png"
+	}
+
+	if err := s.run(ctx, QMPCommand{"screendump", cmdargs}, nil); err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(tmpfile)
+	switch {
+	case os.IsNotExist(err) || (err == nil && len(data) == 0):
+		return "", fmt.Errorf("QEMU has not written the screenshot to %s: is it running on another host or in a different mount namespace?", tmpfile)
+	case err != nil:
+		return "", err
+	}
+
+	img, err := decodeScreendump(data)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode the screendump: %s", err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		return "", err
+	}
+
+	b := img.Bounds()
+
+	return fmt.Sprintf("%s (%dx%d)", path, b.Dx(), b.Dy()), f.Close()
+}
+
+// screendumpPNG reports whether screendump can write PNG,
+// i.e. the schema has the "format" argument with the "png" value.
+func (s *QMPShell) screendumpPNG() bool {
+	if s.schema == nil {
+		return false
+	}
+
+	arg := s.schema.Argument("screendump", "format")
+	if arg == nil {
+		return false
+	}
+
+	for _, v := range s.schema.EnumValues(arg.Type) {
+		if v == "png" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeScreendump decodes the PNG or PPM image written by screendump.
+func decodeScreendump(data []byte) (image.Image, error) {
+	if bytes.HasPrefix(data, []byte("\x89PNG")) {
+		return png.Decode(bytes.NewReader(data))
+	}
+	return decodePPM(bytes.NewReader(data))
+}
+
+// decodePPM decodes a binary PPM (P6) image.
+func decodePPM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+
+	var header [3]int
+
+	magic, err := ppmToken(br)
+	if err != nil {
+		return nil, err
+	}
+	if magic != "P6" {
+		return nil, fmt.Errorf("not a binary PPM image")
+	}
+
+	// Width, height and the maximum color value
+	for i := 0; i < 3; i++ {
+		tok, err := ppmToken(br)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fmt.Sscanf(tok, "%d", &header[i]); err != nil || header[i] <= 0 {
+			return nil, fmt.Errorf("invalid PPM header value: %q", tok)
+		}
+	}
+
+	width, height, maxval := header[0], header[1], header[2]
+	if maxval > 65535 {
+		return nil, fmt.Errorf("invalid PPM maximum value: %d", maxval)
+	}
+
+	// A single whitespace character separates the header and the pixels
+	if _, err := br.ReadByte(); err != nil {
+		return nil, err
+	}
+
+	bpp := 3
+	if maxval > 255 {
+		bpp = 6
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	row := make([]byte, width*bpp)
+
+	scale := func(v int) uint8 {
+		return uint8(v * 255 / maxval)
+	}
+
+	for y := 0; y < height; y++ {
+		if _, err := io.ReadFull(br, row); err != nil {
+			return nil, fmt.Errorf("truncated PPM image: %s", err)
+		}
+		for x := 0; x < width; x++ {
+			var c [3]int
+			for i := range c {
+				if bpp == 3 {
+					c[i] = int(row[x*3+i])
+				} else {
+					c[i] = int(row[x*6+i*2])<<8 | int(row[x*6+i*2+1])
+				}
+			}
+			img.SetRGBA(x, y, color.RGBA{scale(c[0]), scale(c[1]), scale(c[2]), 0xff})
+		}
+	}
+
+	return img, nil
+}
+
+// ppmToken returns the next whitespace-separated token
+// of the PPM header skipping the comments.
+func ppmToken(br *bufio.Reader) (string, error) {
+	var tok []byte
+
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(tok) > 0 {
+				return string(tok), nil
+			}
+			return "", fmt.Errorf("truncated PPM header")
+		}
+
+		switch {
+		case c == '#' && len(tok) == 0:
+			if _, err := br.ReadString('\n'); err != nil {
+				return "", fmt.Errorf("truncated PPM header")
+			}
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			if len(tok) > 0 {
+				// The whitespace after the last header value
+				// belongs to the pixel data separator
+				br.UnreadByte()
+				return string(tok), nil
+			}
+		default:
+			tok = append(tok, c)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+)
+
+func TestDecodePPM(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want color.RGBA
+	}{
+		{
+			name: "8-bit",
+			data: "P6\n2 1\n255\n\x10\x20\x30\x40\x50\x60",
+			want: color.RGBA{0x40, 0x50, 0x60, 0xff},
+		},
+		{
+			name: "comment",
+			data: "P6\n# CREATOR: qemu\n2 1 255\n\x10\x20\x30\x40\x50\x60",
+			want: color.RGBA{0x40, 0x50, 0x60, 0xff},
+		},
+		{
+			name: "16-bit",
+			data: "P6 2 1 65535\n\x00\x00\x00\x00\x00\x00\xff\xff\x80\x00\x00\x00",
+			want: color.RGBA{0xff, 0x7f, 0x00, 0xff},
+		},
+	}
+
+	for _, tt := range tests {
+		img, err := decodePPM(bytes.NewReader([]byte(tt.data)))
+		if err != nil {
+			t.Errorf("%s: decodePPM() error: %s", tt.name, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 1 {
+			t.Errorf("%s: decodePPM() size = %dx%d, want 2x1", tt.name, b.Dx(), b.Dy())
+		}
+		if got := color.RGBAModel.Convert(img.At(1, 0)); got != tt.want {
+			t.Errorf("%s: decodePPM() pixel = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodePPMErrors(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"P3\n1 1\n255\n0 0 0\n",
+		"P6\n2 1\n255\n\x10\x20\x30",
+		"P6\n0 1\n255\n",
+		"P6\n1 1",
+	} {
+		if _, err := decodePPM(bytes.NewReader([]byte(data))); err == nil {
+			t.Errorf("decodePPM(%q): expected an error", data)
+		}
+	}
+}
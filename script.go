@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runScript executes the commands from the file line by line.
+// Empty lines and lines starting with "#" are skipped.
+// Errors are printed and do not stop the execution.
+// The number of failed commands is returned.
+func (s *QMPShell) runScript(ctx context.Context, fname string) (int, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var failed int
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for lineno := 1; scanner.Scan(); lineno++ {
+		cmdline := strings.TrimSpace(scanner.Text())
+
+		if len(cmdline) == 0 || strings.HasPrefix(cmdline, "#") {
+			continue
+		}
+
+		res, err := s.executeCommand(ctx, cmdline)
+		if len(res) > 0 {
+			fmt.Println(res)
+		}
+		switch err {
+		case nil:
+			continue
+		case ErrConnectionClosed, ErrCommandInterrupted:
+			return failed + 1, err
+		}
+
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", fname, lineno, err)
+		failed++
+	}
+
+	return failed, scanner.Err()
+}
+
+// source implements the "source <file>" command.
+func (s *QMPShell) source(ctx context.Context, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("usage: source <file>")
+	}
+
+	failed, err := s.runScript(ctx, strings.Trim(args[1], "\"'"))
+	switch {
+	case err != nil:
+		return "", err
+	case failed > 0:
+		return "", fmt.Errorf("%s: %d command(s) failed", args[1], failed)
+	}
+
+	return "", nil
+}
+
+// ServeCommands reads newline-delimited commands from r until EOF
+// and writes their results to w. Each response is terminated with
+// an empty line, errors are written as "error: <message>".
+// In the JSON output mode the responses are JSON records, one per line.
+// Empty lines and lines starting with "#" are skipped.
+func (s *QMPShell) ServeCommands(r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		cmdline := strings.TrimSpace(scanner.Text())
+
+		if len(cmdline) == 0 || strings.HasPrefix(cmdline, "#") {
+			continue
+		}
+
+		res, err := s.executeCommand(s.ctx, cmdline)
+
+		var werr error
+		if s.jsonOut {
+			_, werr = fmt.Fprintln(w, res)
+		} else {
+			if len(res) > 0 {
+				fmt.Fprintln(w, res)
+			}
+			if err != nil {
+				fmt.Fprintln(w, "error:", err)
+			}
+			_, werr = fmt.Fprintln(w)
+		}
+		if werr != nil {
+			return werr
+		}
+
+		if err == ErrConnectionClosed {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
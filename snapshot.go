@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// snapshotJobID is the ID of the snapshot-save/load/delete jobs.
+const snapshotJobID = "qmp-shell-snapshot"
+
+// snapshotInfo is an internal snapshot of the VM.
+type snapshotInfo struct {
+	ID      string
+	Tag     string
+	VMSize  string
+	Date    string
+	VMClock string
+}
+
+// snapshot implements the "snapshot save|load|delete <tag>" and
+// "snapshot list" commands. If QEMU has the snapshot-save, snapshot-load
+// and snapshot-delete commands, they are used and the job is followed
+// until it is concluded. Otherwise savevm, loadvm, delvm and
+// info snapshots are run using human-monitor-command.
+// By default all writable disks are snapshotted and the VM state
+// is saved to the first one, this can be changed using the
+// vmstate=<node> and devices=<node1,node2,...> arguments.
+func (s *QMPShell) snapshot(ctx context.Context, args []string) (string, error) {
+	const usage = "usage: snapshot save|load|delete <tag> [vmstate=<node>] [devices=<node1,node2,...>] | snapshot list"
+
+	if len(args) == 2 && args[1] == "list" {
+		return s.snapshotList(ctx)
+	}
+
+	if len(args) < 3 {
+		return "", fmt.Errorf(usage)
+	}
+
+	action, tag := args[1], args[2]
+
+	hmpCommands := map[string]string{"save": "savevm", "load": "loadvm", "delete": "delvm"}
+
+	if _, ok := hmpCommands[action]; !ok {
+		return "", fmt.Errorf(usage)
+	}
+
+	var vmstate string
+	var devices []string
+
+	for _, arg := range args[3:] {
+		parts := strings.SplitN(arg, "=", 2)
+		switch {
+		case len(parts) == 2 && parts[0] == "vmstate":
+			vmstate = parts[1]
+		case len(parts) == 2 && parts[0] == "devices":
+			devices = parseList(parts[1])
+		default:
+			return "", fmt.Errorf(usage)
+		}
+	}
+
+	if !s.hasCommand("snapshot-" + action) {
+		if len(vmstate) > 0 || len(devices) > 0 {
+			return "", fmt.Errorf("vmstate and devices require the snapshot-%s command, which is not supported by this QEMU", action)
+		}
+		out, err := s.runHMP(ctx, hmpCommands[action]+" "+tag)
+		if err != nil {
+			return "", err
+		}
+		// These commands print nothing on success
+		if out = strings.TrimSpace(out); len(out) > 0 {
+			return "", fmt.Errorf("%s", strings.TrimPrefix(out, "Error: "))
+		}
+		return fmt.Sprintf("snapshot %s: %s done", tag, action), nil
+	}
+
+	if len(devices) == 0 {
+		var err error
+		if devices, err = s.writableNodes(ctx); err != nil {
+			return "", err
+		}
+		if len(devices) == 0 {
+			return "", fmt.Errorf("no writable disks found, specify them using devices=<node1,node2,...>")
+		}
+	}
+
+	cmdargs := map[string]interface{}{
+		"job-id":  snapshotJobID,
+		"tag":     tag,
+		"devices": devices,
+	}
+
+	if action != "delete" {
+		if len(vmstate) == 0 {
+			vmstate = devices[0]
+		}
+		cmdargs["vmstate"] = vmstate
+	}
+
+	if err := s.run(ctx, QMPCommand{"snapshot-" + action, cmdargs}, nil); err != nil {
+		return "", err
+	}
+
+	if err := s.waitJob(ctx, snapshotJobID); err != nil {
+		return "", fmt.Errorf("snapshot-%s failed: %s", action, err)
+	}
+
+	return fmt.Sprintf("snapshot %s: %s done (%s)", tag, action, strings.Join(devices, ", ")), nil
+}
+
+// snapshotList returns the table of the internal snapshots.
+// It is built from query-block if QEMU has the snapshot-* commands,
+// or from the output of "info snapshots" otherwise.
+func (s *QMPShell) snapshotList(ctx context.Context) (string, error) {
+	var snapshots []snapshotInfo
+
+	if s.hasCommand("snapshot-save") {
+		var err error
+		if snapshots, err = s.querySnapshots(ctx); err != nil {
+			return "", err
+		}
+	} else {
+		out, err := s.runHMP(ctx, "info snapshots")
+		if err != nil {
+			return "", err
+		}
+		if snapshots, err = parseInfoSnapshots(out); err != nil {
+			return "", err
+		}
+	}
+
+	if len(snapshots) == 0 {
+		return "no snapshots", nil
+	}
+
+	rows := make([][]string, 0, len(snapshots))
+
+	for _, sn := range snapshots {
+		rows = append(rows, []string{sn.ID, sn.Tag, sn.VMSize, sn.Date, sn.VMClock})
+	}
+
+	return formatTable([]string{"id", "tag", "vm size", "date", "vm clock"}, rows, nil)
+}
+
+// querySnapshots returns the snapshots of the disks from query-block.
+// A snapshot present on several disks is listed once.
+func (s *QMPShell) querySnapshots(ctx context.Context) ([]snapshotInfo, error) {
+	var devices []struct {
+		Inserted *struct {
+			Image struct {
+				Snapshots []struct {
+					ID          string `json:"id"`
+					Name        string `json:"name"`
+					VMStateSize uint64 `json:"vm-state-size"`
+					DateSec     int64  `json:"date-sec"`
+					VMClockSec  int64  `json:"vm-clock-sec"`
+					VMClockNsec int64  `json:"vm-clock-nsec"`
+				} `json:"snapshots"`
+			} `json:"image"`
+		} `json:"inserted"`
+	}
+
+	if err := s.run(ctx, QMPCommand{"query-block", nil}, &devices); err != nil {
+		return nil, err
+	}
+
+	var snapshots []snapshotInfo
+
+	seen := make(map[string]struct{})
+
+	for _, d := range devices {
+		if d.Inserted == nil {
+			continue
+		}
+		for _, sn := range d.Inserted.Image.Snapshots {
+			if _, ok := seen[sn.Name]; ok {
+				continue
+			}
+			seen[sn.Name] = struct{}{}
+
+			clock := time.Duration(sn.VMClockSec)*time.Second + time.Duration(sn.VMClockNsec)
+
+			snapshots = append(snapshots, snapshotInfo{
+				ID:      sn.ID,
+				Tag:     sn.Name,
+				VMSize:  formatBytes(sn.VMStateSize),
+				Date:    time.Unix(sn.DateSec, 0).Format("2006-01-02 15:04:05"),
+				VMClock: fmt.Sprintf("%02d:%02d:%06.3f", int(clock.Hours()), int(clock.Minutes())%60, float64(clock%time.Minute)/float64(time.Second)),
+			})
+		}
+	}
+
+	return snapshots, nil
+}
+
+// snapshotLineRe matches a snapshot in the output of "info snapshots":
+// the ID ("--" since QEMU 6.0), the tag, the VM state size
+// (e.g. "240M" or "257 MiB"), the date and the VM clock.
+var snapshotLineRe = regexp.MustCompile(`^(\S+)\s+(\S+)\s+(\d+(?:\.\d+)?\s?[KMGTPE]?i?B?)\s+(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d)\s+(\S+)`)
+
+// parseInfoSnapshots parses the output of "info snapshots".
+// Only the snapshots present on all disks are returned.
+// The text not looking like a list of snapshots (e.g. an error message)
+// is returned as an error.
+func parseInfoSnapshots(out string) ([]snapshotInfo, error) {
+	var snapshots []snapshotInfo
+	var header bool
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r ")
+
+		switch {
+		case strings.HasPrefix(line, "There is no snapshot available"):
+			return nil, nil
+		case strings.HasPrefix(line, "List of partial"):
+			// The snapshots that cannot be loaded
+			return snapshots, nil
+		case strings.HasPrefix(line, "ID") && strings.Contains(line, "TAG"):
+			header = true
+		case header:
+			if m := snapshotLineRe.FindStringSubmatch(line); m != nil {
+				snapshots = append(snapshots, snapshotInfo{ID: m[1], Tag: m[2], VMSize: m[3], Date: m[4], VMClock: m[5]})
+			}
+		}
+	}
+
+	if !header {
+		msg := strings.TrimSpace(out)
+		if len(msg) == 0 {
+			msg = "empty output"
+		}
+		return nil, fmt.Errorf("info snapshots: %s", strings.TrimPrefix(msg, "Error: "))
+	}
+
+	return snapshots, nil
+}
+
+// runHMP runs the HMP command using human-monitor-command
+// and returns its output.
+func (s *QMPShell) runHMP(ctx context.Context, cmdline string) (string, error) {
+	var out string
+
+	if err := s.run(ctx, QMPCommand{"human-monitor-command", map[string]string{"command-line": cmdline}}, &out); err != nil {
+		return "", err
+	}
+
+	return out, nil
+}
+
+// writableNodes returns the node names of the writable disks.
+func (s *QMPShell) writableNodes(ctx context.Context) ([]string, error) {
+	var devices []struct {
+		Inserted *struct {
+			NodeName string `json:"node-name"`
+			RO       bool   `json:"ro"`
+		} `json:"inserted"`
+	}
+
+	if err := s.run(ctx, QMPCommand{"query-block", nil}, &devices); err != nil {
+		return nil, err
+	}
+
+	var nodes []string
+
+	for _, d := range devices {
+		if d.Inserted != nil && !d.Inserted.RO && len(d.Inserted.NodeName) > 0 {
+			nodes = append(nodes, d.Inserted.NodeName)
+		}
+	}
+
+	return nodes, nil
+}
+
+// waitJob waits until the job is concluded, then dismisses it.
+// The error of the job is returned.
+func (s *QMPShell) waitJob(ctx context.Context, id string) error {
+	for {
+		var jobs []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+
+		if err := s.run(ctx, QMPCommand{"query-jobs", nil}, &jobs); err != nil {
+			return err
+		}
+
+		var found bool
+
+		for _, j := range jobs {
+			if j.ID != id {
+				continue
+			}
+			found = true
+			if j.Status != "concluded" {
+				break
+			}
+			if err := s.run(ctx, QMPCommand{"job-dismiss", map[string]string{"id": id}}, nil); err != nil {
+				Warning.Printf("cannot dismiss job %s: %s", id, err)
+			}
+			if len(j.Error) > 0 {
+				return fmt.Errorf("%s", j.Error)
+			}
+			return nil
+		}
+
+		// The job was dismissed automatically
+		if !found {
+			return nil
+		}
+
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+			return ErrCommandInterrupted
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInfoSnapshots(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []snapshotInfo
+	}{
+		{
+			name: "qemu-2.12",
+			out: "ID        TAG                 VM SIZE                DATE       VM CLOCK\r\n" +
+				"1         before-upgrade         240M 2019-03-01 10:15:42   00:12:01.123\r\n" +
+				"2         clean                  1.2G 2019-03-02 11:00:00   01:00:00.000\r\n",
+			want: []snapshotInfo{
+				{"1", "before-upgrade", "240M", "2019-03-01 10:15:42", "00:12:01.123"},
+				{"2", "clean", "1.2G", "2019-03-02 11:00:00", "01:00:00.000"},
+			},
+		},
+		{
+			name: "qemu-6.2",
+			out: "List of snapshots present on all disks:\r\n" +
+				"ID        TAG               VM SIZE                DATE     VM CLOCK     ICOUNT\r\n" +
+				"--        snap1             257 MiB 2021-05-03 12:00:00 00:00:10.123          \r\n" +
+				"\r\n" +
+				"List of partial (non-loadable) snapshots on 'drive1':\r\n" +
+				"ID        TAG               VM SIZE                DATE     VM CLOCK     ICOUNT\r\n" +
+				"1         disk-only             0 B 2021-05-03 12:05:00 00:00:00.000          \r\n",
+			want: []snapshotInfo{
+				{"--", "snap1", "257 MiB", "2021-05-03 12:00:00", "00:00:10.123"},
+			},
+		},
+		{
+			name: "none",
+			out:  "There is no snapshot available.\r\n",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := parseInfoSnapshots(tt.out)
+		if err != nil {
+			t.Errorf("%s: parseInfoSnapshots() error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseInfoSnapshots() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseInfoSnapshotsError(t *testing.T) {
+	out := "Error: Device 'drive0' is writable but does not support snapshots\r\n"
+
+	_, err := parseInfoSnapshots(out)
+	if err == nil || err.Error() != "info snapshots: Device 'drive0' is writable but does not support snapshots" {
+		t.Errorf("parseInfoSnapshots() error = %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// socketAddress returns the address of the UNIX socket to dial.
+// Go uses the "@" prefix for sockets in the Linux abstract namespace,
+// so it is added if abstract is true. The "\0" prefix used by some
+// tools to denote abstract sockets is replaced with "@".
+func socketAddress(path string, abstract bool) string {
+	switch {
+	case strings.HasPrefix(path, "\x00"):
+		return "@" + path[1:]
+	case abstract && !strings.HasPrefix(path, "@"):
+		return "@" + path
+	}
+
+	return path
+}
+
+// socketFromPidfile returns the socket path built from the template
+// by replacing "%d" with the PID read from the file, e.g. for
+// "/run/qemu-%d.sock" and the file containing 12345 it is
+// "/run/qemu-12345.sock".
+func socketFromPidfile(template, pidfile string) (string, error) {
+	b, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		return "", err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return "", fmt.Errorf("%s: invalid PID: %q", pidfile, strings.TrimSpace(string(b)))
+	}
+
+	return strings.Replace(template, "%d", strconv.Itoa(pid), -1), nil
+}
+
+// notQMPError is returned by readGreeting if the socket accepts
+// connections, but the peer does not behave like a QMP monitor.
+type notQMPError struct {
+	reason string
+	hint   string
+}
+
+func (e *notQMPError) Error() string {
+	return fmt.Sprintf("this does not look like a QMP socket (%s); %s", e.reason, e.hint)
+}
+
+// readGreeting connects to the socket and returns the QMP greeting
+// (the value of the "QMP" field) sent by QEMU on connection.
+// The monitor discards the greeting, so it is read using
+// a separate short-lived connection. A *notQMPError is returned
+// if no greeting is received within the timeout or the received
+// data is not a QMP greeting.
+func readGreeting(path string, timeout time.Duration) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if len(line) == 0 {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil, &notQMPError{
+				reason: fmt.Sprintf("no greeting received within %s", timeout),
+				hint:   "did you mean -H / a guest-agent socket? The monitor may also be busy with another client",
+			}
+		}
+		return nil, err
+	}
+
+	// The HMP monitor greets with a line like
+	// "QEMU 6.2.0 monitor - type 'help' for more information"
+	if bytes.HasPrefix(line, []byte("QEMU ")) && bytes.Contains(line, []byte(" monitor")) {
+		return nil, &notQMPError{
+			reason: "this is an HMP monitor",
+			hint:   "use a QMP socket (-qmp or -mon mode=control), -H runs HMP commands over it",
+		}
+	}
+
+	greeting := struct {
+		QMP json.RawMessage `json:"QMP"`
+	}{}
+
+	if err := json.Unmarshal(line, &greeting); err != nil || greeting.QMP == nil {
+		if len(line) > 64 {
+			line = line[:64]
+		}
+		return nil, &notQMPError{
+			reason: fmt.Sprintf("unexpected greeting: %q", line),
+			hint:   "did you mean -H / a guest-agent socket?",
+		}
+	}
+
+	return greeting.QMP, nil
+}
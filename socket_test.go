@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSocketAddress(t *testing.T) {
+	tests := []struct {
+		path     string
+		abstract bool
+		want     string
+	}{
+		{"/run/vm.qmp", false, "/run/vm.qmp"},
+		{"vm.qmp", false, "vm.qmp"},
+		{"@qemu/vm", false, "@qemu/vm"},
+		{"\x00qemu/vm", false, "@qemu/vm"},
+		{"qemu/vm", true, "@qemu/vm"},
+		{"@qemu/vm", true, "@qemu/vm"},
+		{"\x00qemu/vm", true, "@qemu/vm"},
+	}
+
+	for _, tt := range tests {
+		if got := socketAddress(tt.path, tt.abstract); got != tt.want {
+			t.Errorf("socketAddress(%q, %t) = %q, want %q", tt.path, tt.abstract, got, tt.want)
+		}
+	}
+}
+
+func TestSocketAddressDialAbstract(t *testing.T) {
+	name := fmt.Sprintf("qmp-shell-test-%d", os.Getpid())
+
+	l, err := net.Listen("unix", "@"+name)
+	if err != nil {
+		t.Skipf("abstract sockets are not supported: %s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("unix", socketAddress(name, true))
+	if err != nil {
+		t.Fatalf("cannot dial the abstract socket: %s", err)
+	}
+	conn.Close()
+}
+
+func TestReadGreeting(t *testing.T) {
+	tests := []struct {
+		name  string
+		send  string
+		isQMP bool
+	}{
+		{"qmp", `{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 6}}, "capabilities": ["oob"]}}` + "\r\n", true},
+		{"hmp", "QEMU 6.2.0 monitor - type 'help' for more information\r\n(qemu) ", false},
+		{"serial", "\r\nUbuntu 22.04 LTS vm ttyS0\r\n\r\nvm login: ", false},
+		{"silent", "", false},
+	}
+
+	for _, tt := range tests {
+		path := fmt.Sprintf("@qmp-shell-test-%d-%s", os.Getpid(), tt.name)
+
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Skipf("abstract sockets are not supported: %s", err)
+		}
+
+		go func(send string) {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if len(send) > 0 {
+				conn.Write([]byte(send))
+			}
+			// Waiting for the client to close the connection
+			conn.Read(make([]byte, 1))
+		}(tt.send)
+
+		greeting, err := readGreeting(path, 200*time.Millisecond)
+		l.Close()
+
+		if tt.isQMP {
+			if err != nil || greeting == nil {
+				t.Errorf("%s: readGreeting() = %s, %v, want the greeting", tt.name, greeting, err)
+			}
+			continue
+		}
+		if _, ok := err.(*notQMPError); !ok {
+			t.Errorf("%s: readGreeting() error = %v, want *notQMPError", tt.name, err)
+		}
+	}
+}
+
+func TestSocketFromPidfile(t *testing.T) {
+	f, err := ioutil.TempFile("", "qmp-shell-test-pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tests := []struct {
+		content string
+		want    string
+		isErr   bool
+	}{
+		{"12345\n", "/run/qemu-12345.sock", false},
+		{"  777  ", "/run/qemu-777.sock", false},
+		{"", "", true},
+		{"abc\n", "", true},
+		{"-1\n", "", true},
+	}
+
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(f.Name(), []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := socketFromPidfile("/run/qemu-%d.sock", f.Name())
+		switch {
+		case tt.isErr && err == nil:
+			t.Errorf("socketFromPidfile(%q): expected an error, got %q", tt.content, got)
+		case !tt.isErr && (err != nil || got != tt.want):
+			t.Errorf("socketFromPidfile(%q) = %q, %v, want %q", tt.content, got, err, tt.want)
+		}
+	}
+
+	if _, err := socketFromPidfile("/run/qemu-%d.sock", f.Name()+".missing"); err == nil {
+		t.Errorf("socketFromPidfile() with a missing file: expected an error")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sshTunnel is a local UNIX socket forwarded to the remote one
+// by the ssh client. The client is used instead of an SSH library
+// so that the user's SSH configuration (known hosts, agent,
+// ProxyJump and so on) is applied as usual.
+type sshTunnel struct {
+	cmd    *exec.Cmd
+	dest   string
+	dir    string
+	socket string
+	done   chan struct{}
+	stderr bytes.Buffer
+}
+
+// openSSHTunnel runs the ssh client to forward a local socket
+// to the remote socket path on the given host ("[user@]host").
+// The agent and the default keys are used for authentication
+// unless keyfile is specified.
+func openSSHTunnel(dest, keyfile, remote string, timeout time.Duration) (*sshTunnel, error) {
+	if strings.HasPrefix(remote, "@") {
+		return nil, fmt.Errorf("abstract sockets cannot be forwarded over SSH: %s", remote)
+	}
+
+	dir, err := ioutil.TempDir("", "qmp-shell-ssh")
+	if err != nil {
+		return nil, err
+	}
+
+	t := sshTunnel{
+		dest:   dest,
+		dir:    dir,
+		socket: filepath.Join(dir, "qmp.sock"),
+		done:   make(chan struct{}),
+	}
+
+	args := []string{
+		"-n", "-N", "-T",
+		"-o", "ExitOnForwardFailure=yes",
+		"-L", t.socket + ":" + remote,
+	}
+	if len(keyfile) > 0 {
+		args = append(args, "-i", keyfile, "-o", "IdentitiesOnly=yes")
+	}
+	args = append(args, dest)
+
+	t.cmd = exec.Command("ssh", args...)
+	t.cmd.Stderr = &t.stderr
+
+	if err := t.cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("cannot run ssh: %s", err)
+	}
+
+	go func() {
+		t.cmd.Wait()
+		close(t.done)
+	}()
+
+	atExit(t.Close)
+
+	// The local socket appears once the connection is established
+	deadline := time.After(timeout)
+
+	for {
+		if _, err := os.Stat(t.socket); err == nil {
+			return &t, nil
+		}
+
+		select {
+		case <-t.done:
+			t.Close()
+			return nil, fmt.Errorf("ssh connection to %s failed: %s", dest, strings.TrimSpace(t.stderr.String()))
+		case <-deadline:
+			t.Close()
+			return nil, fmt.Errorf("ssh connection to %s timed out", dest)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// Close stops the ssh client and removes the local socket.
+// It is safe to call Close more than once.
+func (t *sshTunnel) Close() {
+	select {
+	case <-t.done:
+	default:
+		t.cmd.Process.Kill()
+		<-t.done
+	}
+
+	os.RemoveAll(t.dir)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/0xef53/go-qmp/v2"
+)
+
+type txnAction struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// startTxn implements the "txn" command that enters the transaction mode.
+// In this mode the commands are not executed, but accumulated as actions
+// until "commit" or "abort" is entered. On "commit" all of them are sent
+// using a single "transaction" command, so they are performed atomically.
+func (s *QMPShell) startTxn(ctx context.Context, args []string) (string, error) {
+	switch {
+	case len(args) != 1:
+		return "", fmt.Errorf("usage: txn")
+	case s.isHMP:
+		return "", fmt.Errorf("transactions are not supported in the HMP mode")
+	case s.txn != nil:
+		return "", fmt.Errorf("already in the transaction mode")
+	}
+
+	s.txn = []txnAction{}
+
+	return "Transaction mode: enter actions, then commit or abort", nil
+}
+
+// transactionActions returns the list of commands
+// that can be performed within a transaction.
+func (s *QMPShell) transactionActions() []string {
+	if s.schema != nil {
+		if names := s.schema.TransactionActions(); len(names) > 0 {
+			return names
+		}
+	}
+
+	names := make([]string, 0, len(qmp.AllowedTransactionActions))
+	for name := range qmp.AllowedTransactionActions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// txnCommand handles the command line in the transaction mode.
+// Built-in commands (except "commit" and "abort") are not handled,
+// so the second return value is false for them.
+func (s *QMPShell) txnCommand(ctx context.Context, cmdline string) (string, bool, error) {
+	name := strings.Fields(cmdline)[0]
+
+	switch name {
+	case "commit":
+		s.recordCommand(cmdline)
+		actions := s.txn
+		s.txn = nil
+		if len(actions) == 0 {
+			return "", true, fmt.Errorf("transaction is empty, nothing to commit")
+		}
+		res, err := s.sendCommand(ctx, &QMPCommand{"transaction", map[string]interface{}{"actions": actions}}, s.cmdTimeout)
+		return res, true, err
+	case "abort":
+		s.recordCommand(cmdline)
+		s.txn = nil
+		return "Transaction aborted", true, nil
+	}
+
+	if _, ok := builtinCommands[name]; ok {
+		return "", false, nil
+	}
+
+	cmd, err := s.buildQMPCommand(cmdline)
+	if err != nil {
+		return "", true, err
+	}
+
+	actions := s.transactionActions()
+	if i := sort.SearchStrings(actions, cmd.Name); i == len(actions) || actions[i] != cmd.Name {
+		return "", true, fmt.Errorf("%s cannot be used in a transaction (allowed: %s)", cmd.Name, strings.Join(actions, ", "))
+	}
+
+	s.recordCommand(cmdline)
+	s.txn = append(s.txn, txnAction{Type: cmd.Name, Data: cmd.Arguments})
+
+	return "", true, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// checkCommand makes sure that the command exists in the schema.
+func (sc *Schema) checkCommand(cmd *QMPCommand) error {
+	if sc.Command(cmd.Name) == nil {
+		return fmt.Errorf("unknown command: %s", cmd.Name)
+	}
+	return nil
+}
+
+// checkRequiredArguments makes sure that all required arguments
+// of the command are present. Commands that are not described
+// by the schema are not checked.
+func (sc *Schema) checkRequiredArguments(cmd *QMPCommand) error {
+	args, _ := cmd.Arguments.(map[string]interface{})
+
+	if missing := sc.MissingArguments(cmd.Name, args); len(missing) > 0 {
+		return fmt.Errorf("missing required arguments for %s: %s", cmd.Name, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// validateArguments makes sure that all the given arguments
+// are members of the command and their values have suitable types.
+// Commands that are not described by the schema are not checked.
+func (sc *Schema) validateArguments(cmd *QMPCommand) error {
+	if sc.Command(cmd.Name) == nil {
+		return nil
+	}
+
+	members := make(map[string]*SchemaMember)
+	for _, m := range sc.Arguments(cmd.Name) {
+		m := m
+		members[m.Name] = &m
+	}
+
+	args, _ := cmd.Arguments.(map[string]interface{})
+
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m, ok := members[name]
+		if !ok {
+			return fmt.Errorf("unknown argument '%s' for %s; valid arguments: %s", name, cmd.Name, argumentList(members))
+		}
+
+		if t := sc.JSONType(m.Type); !matchJSONType(t, args[name]) {
+			return fmt.Errorf("invalid value for argument '%s' of %s: expected %s", name, cmd.Name, t)
+		}
+	}
+
+	return nil
+}
+
+// matchJSONType reports whether the value built by buildQMPCommand
+// can be of the given JSON type. Only obvious mismatches are detected:
+// e.g. numeric strings are allowed where a number is required,
+// as well as numbers and booleans where a string is required.
+func matchJSONType(t string, v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return t == "object" || t == "value"
+	case []interface{}:
+		return t == "array" || t == "value"
+	case bool:
+		return t != "int" && t != "number" && t != "object" && t != "array"
+	case int64:
+		return t != "boolean" && t != "object" && t != "array"
+	case string:
+		switch t {
+		case "int":
+			_, err := strconv.ParseInt(v, 0, 64)
+			return err == nil
+		case "number":
+			_, err := strconv.ParseFloat(v, 64)
+			return err == nil
+		case "boolean", "object", "array":
+			return false
+		}
+	}
+
+	return true
+}
+
+func argumentList(members map[string]*SchemaMember) string {
+	if len(members) == 0 {
+		return "none"
+	}
+
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// deprecatedReplacements suggests replacements for the commands
+// that are deprecated in QEMU. The schema itself does not name them.
+var deprecatedReplacements = map[string]string{
+	"change":                   "blockdev-change-medium or change-vnc-password",
+	"cpu-add":                  "device_add",
+	"migrate-set-cache-size":   "migrate-set-parameters",
+	"migrate_set_downtime":     "migrate-set-parameters",
+	"migrate_set_speed":        "migrate-set-parameters",
+	"query-cpus":               "query-cpus-fast",
+	"query-events":             "query-qmp-schema",
+	"query-migrate-cache-size": "query-migrate-parameters",
+}
+
+// warnDeprecated prints a warning to stderr if the command
+// or any of its arguments is marked as deprecated in the schema.
+// Each warning is printed only once per session.
+func (s *QMPShell) warnDeprecated(cmd *QMPCommand) {
+	warn := func(key, msg string) {
+		if _, ok := s.deprecationWarned[key]; ok {
+			return
+		}
+		s.deprecationWarned[key] = struct{}{}
+		Warning.Println(msg)
+	}
+
+	if s.schema.Deprecated(cmd.Name, "") {
+		msg := fmt.Sprintf("'%s' is deprecated", cmd.Name)
+		if r, ok := deprecatedReplacements[cmd.Name]; ok {
+			msg += fmt.Sprintf(", use %s instead", r)
+		}
+		warn(cmd.Name, msg)
+	}
+
+	args, _ := cmd.Arguments.(map[string]interface{})
+
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if s.schema.Deprecated(cmd.Name, name) {
+			warn(cmd.Name+" "+name, fmt.Sprintf("argument '%s' of '%s' is deprecated", name, cmd.Name))
+		}
+	}
+}
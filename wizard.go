@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const msgWizardCancelled = "cancelled"
+
+// wizardProperty is a property of a device, a backend or an object
+// the user is asked for.
+type wizardProperty struct {
+	Name        string          `json:"name"`
+	Type        string          `json:"type"`
+	Description string          `json:"description"`
+	Default     json.RawMessage `json:"default-value"`
+
+	required bool
+}
+
+// wizardSpec describes how the wizard builds a command: the argument
+// with the type of the thing being added (e.g. the device driver),
+// the list of the types for the completion and the list
+// of the properties of the chosen type.
+type wizardSpec struct {
+	typeArg    string
+	types      func(s *QMPShell, ctx context.Context) []string
+	properties func(s *QMPShell, ctx context.Context, typename string) ([]wizardProperty, error)
+}
+
+var wizardSpecs = map[string]wizardSpec{
+	"device_add": {
+		typeArg: "driver",
+		types: func(s *QMPShell, ctx context.Context) []string {
+			return s.qomTypes(ctx, "device")
+		},
+		properties: func(s *QMPShell, ctx context.Context, typename string) ([]wizardProperty, error) {
+			props, err := s.qomProperties(ctx, "device-list-properties", typename)
+			if err != nil {
+				return nil, err
+			}
+			return append([]wizardProperty{{Name: "id", Type: "str"}}, props...), nil
+		},
+	},
+	"object-add": {
+		typeArg: "qom-type",
+		types: func(s *QMPShell, ctx context.Context) []string {
+			return s.qomTypes(ctx, "user-creatable")
+		},
+		properties: func(s *QMPShell, ctx context.Context, typename string) ([]wizardProperty, error) {
+			props, err := s.qomProperties(ctx, "qom-list-properties", typename)
+			if err != nil {
+				return nil, err
+			}
+			return append([]wizardProperty{{Name: "id", Type: "str", required: true}}, props...), nil
+		},
+	},
+	"netdev_add": {
+		typeArg: "type",
+		types: func(s *QMPShell, ctx context.Context) []string {
+			if s.schema == nil {
+				return nil
+			}
+			_, cases := s.schema.Discriminator("netdev_add")
+			return cases
+		},
+		properties: func(s *QMPShell, ctx context.Context, typename string) ([]wizardProperty, error) {
+			if s.schema == nil {
+				return nil, fmt.Errorf("the QMP schema is not available")
+			}
+			if tag, _ := s.schema.Discriminator("netdev_add"); tag != "type" {
+				return nil, fmt.Errorf("the netdev_add arguments are not described in the schema of this QEMU version")
+			}
+			var props []wizardProperty
+			for _, m := range s.schema.VariantArguments("netdev_add", typename) {
+				props = append(props, wizardProperty{
+					Name:     m.Name,
+					Type:     s.schema.TypeName(m.Type),
+					required: !m.Optional(),
+				})
+			}
+			return props, nil
+		},
+	},
+}
+
+// wizard implements the "wizard <command>" command that builds
+// the device_add, object-add or netdev_add command interactively:
+// it asks for the type (with the completion) and then for each
+// of its properties, showing the type and the default value.
+// Properties left blank are skipped. The assembled command
+// is executed after the confirmation.
+func (s *QMPShell) wizard(ctx context.Context, args []string) (string, error) {
+	names := make([]string, 0, len(wizardSpecs))
+	for n := range wizardSpecs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	if len(args) != 2 {
+		return "", fmt.Errorf("usage: wizard %s", strings.Join(names, "|"))
+	}
+
+	spec, ok := wizardSpecs[args[1]]
+	if !ok {
+		return "", fmt.Errorf("no wizard for %s (available: %s)", args[1], strings.Join(names, ", "))
+	}
+
+	if s.isHMP || !isatty(os.Stdin) {
+		return "", fmt.Errorf("the wizard is only available in the interactive QMP shell")
+	}
+
+	// The prompts below go through the line editor,
+	// so the completer is replaced while they are shown
+	defer func() {
+		if s.completion == completionNone {
+			s.line.SetCompleter(nil)
+		} else {
+			s.line.SetWordCompleter(s.complete)
+		}
+	}()
+
+	types := spec.types(s, ctx)
+
+	s.line.SetCompleter(func(line string) []string {
+		return completeFromList(types, line)
+	})
+
+	var typename string
+	for len(typename) == 0 {
+		v, err := s.line.Prompt(spec.typeArg + ": ")
+		if err != nil {
+			return msgWizardCancelled, nil
+		}
+		typename = strings.TrimSpace(v)
+	}
+
+	props, err := spec.properties(s, ctx, typename)
+	if err != nil {
+		return "", err
+	}
+
+	s.line.SetCompleter(nil)
+
+	cmdline := fmt.Sprintf("%s %s=%s", args[1], spec.typeArg, quoteArgValue(typename))
+
+	fmt.Printf("%d properties, leave blank to skip\n", len(props))
+
+	for _, p := range props {
+		if len(p.Description) > 0 {
+			fmt.Printf("# %s\n", p.Description)
+		}
+
+		prompt := fmt.Sprintf("%s <%s>", p.Name, p.Type)
+		switch {
+		case p.required:
+			prompt += " (required)"
+		case len(p.Default) > 0:
+			prompt += fmt.Sprintf(" [%s]", p.Default)
+		}
+
+		for {
+			v, err := s.line.Prompt(prompt + ": ")
+			if err != nil {
+				return msgWizardCancelled, nil
+			}
+			if v = strings.TrimSpace(v); len(v) > 0 {
+				cmdline += fmt.Sprintf(" %s=%s", p.Name, quoteArgValue(v))
+				break
+			}
+			if !p.required {
+				break
+			}
+		}
+	}
+
+	fmt.Println(cmdline)
+
+	if ok, err := s.confirm("Execute?"); err != nil || !ok {
+		return msgWizardCancelled, nil
+	}
+
+	// The assembled command is saved in the history,
+	// so it can be edited and repeated later
+	res, err := s.executeOne(ctx, cmdline)
+	s.recordHistory(cmdline, err)
+
+	return res, err
+}
+
+// quoteArgValue quotes the argument value if it contains spaces.
+func quoteArgValue(v string) string {
+	if !strings.ContainsAny(v, " \t") {
+		return v
+	}
+	if strings.Contains(v, "'") {
+		return `"` + v + `"`
+	}
+	return "'" + v + "'"
+}
+
+// qomTypes returns the sorted names of the non-abstract
+// QOM types implementing the given type.
+func (s *QMPShell) qomTypes(ctx context.Context, implements string) []string {
+	var types []struct {
+		Name string `json:"name"`
+	}
+
+	cmd := QMPCommand{"qom-list-types", map[string]interface{}{"implements": implements, "abstract": false}}
+
+	if err := s.run(ctx, cmd, &types); err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		names = append(names, t.Name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// qomProperties returns the properties of the QOM type using
+// device-list-properties or qom-list-properties.
+func (s *QMPShell) qomProperties(ctx context.Context, cmdname, typename string) ([]wizardProperty, error) {
+	var props []wizardProperty
+
+	if err := s.run(ctx, QMPCommand{cmdname, map[string]string{"typename": typename}}, &props); err != nil {
+		return nil, err
+	}
+
+	// Child objects are created by QEMU itself
+	out := props[:0]
+	for _, p := range props {
+		if !strings.HasPrefix(p.Type, "child<") && p.Name != "type" {
+			out = append(out, p)
+		}
+	}
+
+	return out, nil
+}